@@ -0,0 +1,220 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/common"
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/database"
+	"github.com/gorilla/mux"
+)
+
+// the largest body accepted by the admin endpoints
+const maxAdminBodySize = 4096
+
+func userResponse(user database.GetUserResult) UserResponse {
+	return UserResponse{
+		ID:          user.UserId,
+		Permissions: uint32(user.Permissions),
+		Names:       user.Permissions.List(),
+		TokenPrefix: user.TokenPrefix,
+		Label:       user.Label,
+		CreatedAt:   user.CreatedAt,
+		ExpiresAt:   user.ExpiresAt,
+		LastUsedAt:  user.LastUsedAt,
+		CertSubject: user.CertSubject,
+	}
+}
+
+func parseUserId(r *http.Request) (uint64, bool) {
+	value, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	return value, err == nil
+}
+
+// canManage reports whether the caller holds every permission in target.
+// Creating, rotating or revoking a user hands out or takes away a token with
+// those permissions, so managing users must not reach beyond the caller's own.
+func canManage(r *http.Request, target common.Permission) bool {
+	principal, ok := PrincipalFromContext(r.Context())
+	return ok && principal.Permissions.Has(target)
+}
+
+// canManageUser is canManage for an existing user, it returns
+// database.ErrUserNotFound if there is no user with the id
+func (s *Server) canManageUser(r *http.Request, id uint64) (bool, error) {
+	user, err := s.db.GetUser(r.Context(), id)
+
+	if err != nil {
+		return false, err
+	}
+
+	return canManage(r, user.Permissions), nil
+}
+
+// errManageForbidden is written when canManage or canManageUser refuse
+var errManageForbidden = ErrForbidden.WithMessage("you cannot manage a user with permissions you do not hold")
+
+func (s *Server) HandleListUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := s.db.GetAllUsers(r.Context())
+
+	if err != nil {
+		WriteError(w, r, ErrInternal, err)
+		return
+	}
+
+	out := []UserResponse{}
+
+	for _, user := range users {
+		out = append(out, userResponse(user))
+	}
+
+	WriteJSON(w, r, out, http.StatusOK)
+}
+
+func (s *Server) HandleCreateUser(w http.ResponseWriter, r *http.Request) {
+	var body CreateUserRequest
+
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminBodySize))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&body); err != nil {
+		WriteError(w, r, ErrBadRequest.WithMessage("invalid json body"), nil)
+		return
+	}
+
+	permissions := common.Permission(body.Permissions)
+
+	if len(body.PermissionNames) > 0 {
+		parsed, err := common.ParsePermissions(strings.Join(body.PermissionNames, ","))
+
+		if err != nil {
+			WriteError(w, r, ErrBadRequest.WithMessage(err.Error()), nil)
+			return
+		}
+
+		permissions = permissions.Add(parsed)
+	}
+
+	if !permissions.Valid() {
+		WriteError(w, r, ErrBadRequest.WithMessage("permissions contains unknown bits"), nil)
+		return
+	}
+
+	if body.ExpiresAt != nil && !body.ExpiresAt.After(time.Now()) {
+		WriteError(w, r, ErrBadRequest.WithMessage("expires_at must be in the future"), nil)
+		return
+	}
+
+	if body.CertSubject != nil && *body.CertSubject == "" {
+		WriteError(w, r, ErrBadRequest.WithMessage("cert_subject must not be empty"), nil)
+		return
+	}
+
+	if !canManage(r, permissions) {
+		WriteError(w, r, errManageForbidden, nil)
+		return
+	}
+
+	user, token, err := s.db.CreateUser(r.Context(), database.CreateUserOptions{
+		Permissions: permissions,
+		Label:       body.Label,
+		ExpiresAt:   body.ExpiresAt,
+		CertSubject: body.CertSubject,
+	})
+
+	if err != nil && errors.Is(err, database.ErrCertSubjectTaken) {
+		WriteError(w, r, ErrConflict.WithMessage(err.Error()), nil)
+		return
+	}
+
+	if err != nil {
+		WriteError(w, r, ErrInternal, err)
+		return
+	}
+
+	WriteJSON(w, r, TokenResponse{
+		UserResponse: userResponse(user),
+		Token:        token,
+	}, http.StatusCreated)
+}
+
+func (s *Server) HandleRotateToken(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseUserId(r)
+
+	if !ok {
+		WriteError(w, r, ErrBadRequest.WithMessage("id is not a valid uint64"), nil)
+		return
+	}
+
+	allowed, err := s.canManageUser(r, id)
+
+	if err == nil && !allowed {
+		WriteError(w, r, errManageForbidden, nil)
+		return
+	}
+
+	var user database.GetUserResult
+	var token string
+
+	if err == nil {
+		user, token, err = s.db.RotateToken(r.Context(), id)
+	}
+
+	if err != nil && errors.Is(err, database.ErrUserNotFound) {
+		WriteError(w, r, ErrNotFound, nil)
+		return
+	}
+
+	if err != nil {
+		WriteError(w, r, ErrInternal, err)
+		return
+	}
+
+	WriteJSON(w, r, TokenResponse{
+		UserResponse: userResponse(user),
+		Token:        token,
+	}, http.StatusOK)
+}
+
+func (s *Server) HandleRevokeUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseUserId(r)
+
+	if !ok {
+		WriteError(w, r, ErrBadRequest.WithMessage("id is not a valid uint64"), nil)
+		return
+	}
+
+	// revoking yourself would leave the caller locked out, which is almost certainly
+	// not what was intended (and could remove the last admin)
+	if user, ok := PrincipalFromContext(r.Context()); ok && user.UserId == id {
+		WriteError(w, r, ErrBadRequest.WithMessage("you cannot revoke your own token"), nil)
+		return
+	}
+
+	allowed, err := s.canManageUser(r, id)
+
+	if err == nil && !allowed {
+		WriteError(w, r, errManageForbidden, nil)
+		return
+	}
+
+	if err == nil {
+		err = s.db.RevokeUser(r.Context(), id)
+	}
+
+	if err != nil && errors.Is(err, database.ErrUserNotFound) {
+		WriteError(w, r, ErrNotFound, nil)
+		return
+	}
+
+	if err != nil {
+		WriteError(w, r, ErrInternal, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
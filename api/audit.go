@@ -0,0 +1,142 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/database"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+const defaultAuditLogLimit = 100
+const maxAuditLogLimit = 1000
+
+// AuditMiddleware records who accessed the route, and how it went, to the
+// audit log. It must be wrapped by AuthMiddleware.
+func (s *Server) AuditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := PrincipalFromContext(r.Context())
+
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		requestId := requestID(w)
+
+		route := r.URL.Path
+
+		if current := mux.CurrentRoute(r); current != nil {
+			if tmpl, err := current.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+
+		recorder := newStatusRecorder(w)
+		start := time.Now()
+
+		next.ServeHTTP(recorder, r)
+
+		// not the request context, the entry is still wanted if the client hung up
+		err := s.db.AddAuditLog(context.Background(), database.AuditLogEntry{
+			RequestID:  requestId,
+			UserId:     user.UserId,
+			Method:     r.Method,
+			Route:      route,
+			Status:     recorder.status,
+			Duration:   time.Since(start),
+			RemoteAddr: r.RemoteAddr,
+		})
+
+		if err != nil {
+			LoggerFromContext(r.Context()).Named("audit").Error(
+				"could not write audit log",
+				zap.Uint64("user", user.UserId),
+				zap.Error(err),
+			)
+		}
+	})
+}
+
+func parseTimeParam(r *http.Request, name string) (*time.Time, bool) {
+	value := r.URL.Query().Get(name)
+
+	if value == "" {
+		return nil, true
+	}
+
+	parsed, err := time.Parse(time.RFC3339, value)
+
+	if err != nil {
+		return nil, false
+	}
+
+	return &parsed, true
+}
+
+func (s *Server) HandleGetAuditLog(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := database.AuditLogFilter{Limit: defaultAuditLogLimit}
+
+	var ok bool
+
+	if filter.Since, ok = parseTimeParam(r, "since"); !ok {
+		WriteError(w, r, ErrBadRequest.WithMessage("since must be an RFC 3339 timestamp"), nil)
+		return
+	}
+
+	if filter.Until, ok = parseTimeParam(r, "until"); !ok {
+		WriteError(w, r, ErrBadRequest.WithMessage("until must be an RFC 3339 timestamp"), nil)
+		return
+	}
+
+	if value := query.Get("user_id"); value != "" {
+		id, err := strconv.ParseUint(value, 10, 64)
+
+		if err != nil {
+			WriteError(w, r, ErrBadRequest.WithMessage("user_id is not a valid uint64"), nil)
+			return
+		}
+
+		filter.UserId = &id
+	}
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.ParseUint(value, 10, 64)
+
+		if err != nil || limit == 0 || limit > maxAuditLogLimit {
+			WriteError(w, r, ErrBadRequest.WithMessage("limit must be in 1..1000"), nil)
+			return
+		}
+
+		filter.Limit = limit
+	}
+
+	entries, err := s.db.GetAuditLog(r.Context(), filter)
+
+	if err != nil {
+		WriteError(w, r, ErrInternal, err)
+		return
+	}
+
+	out := []AuditLogResponse{}
+
+	for _, entry := range entries {
+		out = append(out, AuditLogResponse{
+			ID:         entry.ID,
+			CreatedAt:  entry.CreatedAt,
+			RequestID:  entry.RequestID,
+			UserID:     entry.UserId,
+			Method:     entry.Method,
+			Route:      entry.Route,
+			Status:     entry.Status,
+			DurationMs: entry.Duration.Milliseconds(),
+			RemoteAddr: entry.RemoteAddr,
+		})
+	}
+
+	WriteJSON(w, r, out, http.StatusOK)
+}
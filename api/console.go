@@ -0,0 +1,536 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/common"
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/database"
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/metrics"
+	"go.uber.org/zap"
+)
+
+//go:embed console/*.html
+var consoleFS embed.FS
+
+const consoleCookie = "console_session"
+const consoleSessionTTL = time.Hour * 12
+
+// the login form has no session to carry its CSRF token, so the token is kept
+// in its own cookie and must match the one posted with the form
+const consoleLoginCookie = "console_login"
+const consoleLoginTTL = time.Hour
+
+// the format used by <input type="datetime-local">
+const datetimeLocalFormat = "2006-01-02T15:04"
+
+var consoleTemplates = loadConsoleTemplates("login", "status", "users", "audit", "error")
+
+func loadConsoleTemplates(pages ...string) map[string]*template.Template {
+	out := map[string]*template.Template{}
+
+	for _, page := range pages {
+		out[page] = template.Must(template.ParseFS(consoleFS, "console/layout.html", fmt.Sprintf("console/%s.html", page)))
+	}
+
+	return out
+}
+
+type consoleNav struct {
+	Users bool
+	Audit bool
+}
+
+type consolePage struct {
+	Title   string
+	Session *database.GetSessionResult
+	Nav     consoleNav
+	Flash   string
+	Error   string
+	Data    interface{}
+}
+
+type consoleLoginData struct {
+	Csrf string
+}
+
+type consoleStatusData struct {
+	Count       uint64
+	Users       int
+	Permissions string
+	ShowProxies bool
+	Proxies     []string
+}
+
+type consoleUsersData struct {
+	Users        []RenderUserData
+	Permissions  []string
+	NewToken     string
+	NewTokenUser uint64
+}
+
+type consoleAuditData struct {
+	Since   string
+	Until   string
+	UserId  string
+	Entries []database.AuditLogEntry
+}
+
+type consoleSessionKey struct{}
+
+func consoleSessionFromContext(ctx context.Context) (database.GetSessionResult, bool) {
+	session, ok := ctx.Value(consoleSessionKey{}).(database.GetSessionResult)
+	return session, ok
+}
+
+func (s *Server) renderConsole(w http.ResponseWriter, r *http.Request, status int, name string, page consolePage) {
+	if session, ok := consoleSessionFromContext(r.Context()); ok {
+		page.Session = &session
+		page.Nav = consoleNav{
+			Users: session.Permissions.Has(common.PermissionManageUsers),
+			Audit: session.Permissions.Has(common.PermissionAdmin),
+		}
+	}
+
+	// rendered to a buffer first so that a template error doesn't leave half a page behind
+	var out bytes.Buffer
+
+	if err := consoleTemplates[name].ExecuteTemplate(&out, "layout", page); err != nil {
+		LoggerFromContext(r.Context()).Named("console").Error("could not render page", zap.String("page", name), zap.Error(err))
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(status)
+	w.Write(out.Bytes())
+}
+
+func (s *Server) renderConsoleError(w http.ResponseWriter, r *http.Request, status int) {
+	s.renderConsole(w, r, status, "error", consolePage{Title: http.StatusText(status)})
+}
+
+// SessionMiddleware is the console equivalent of AuthMiddleware, authenticating
+// with the session cookie instead of a token. Unsafe methods must also carry
+// the session's CSRF token in the csrf form field.
+func (s *Server) SessionMiddleware(next http.Handler, permission common.Permission) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(consoleCookie)
+
+		if err != nil {
+			http.Redirect(w, r, "/console/login", http.StatusSeeOther)
+			return
+		}
+
+		session, err := s.db.GetSession(r.Context(), cookie.Value)
+
+		if err != nil && errors.Is(err, database.ErrSessionNotFound) {
+			s.clearConsoleCookie(w, r)
+			http.Redirect(w, r, "/console/login", http.StatusSeeOther)
+			return
+		}
+
+		if err != nil {
+			LoggerFromContext(r.Context()).Named("console").Error("error checking session", zap.Error(err))
+			s.renderConsoleError(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), consoleSessionKey{}, session)
+		ctx = withPrincipal(ctx, Principal{
+			UserId:      session.UserId,
+			Permissions: session.Permissions,
+		})
+
+		r = r.WithContext(ctx)
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			csrf := r.PostFormValue("csrf")
+
+			if subtle.ConstantTimeCompare([]byte(csrf), []byte(session.CsrfToken)) != 1 {
+				s.renderConsoleError(w, r, http.StatusForbidden)
+				return
+			}
+		}
+
+		if permission != 0 && !session.Permissions.Has(permission) {
+			s.renderConsoleError(w, r, http.StatusForbidden)
+			return
+		}
+
+		s.db.MarkUsed(session.UserId)
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) setCookie(w http.ResponseWriter, r *http.Request, name string, path string, value string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   s.secureCookies || r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+func (s *Server) setConsoleCookie(w http.ResponseWriter, r *http.Request, value string, expires time.Time) {
+	s.setCookie(w, r, consoleCookie, "/console", value, expires)
+}
+
+func (s *Server) clearConsoleCookie(w http.ResponseWriter, r *http.Request) {
+	s.setConsoleCookie(w, r, "", time.Unix(0, 0))
+}
+
+// loginCsrf returns the CSRF token for the login form, reusing the one in the
+// request's cookie so that the form works across several open tabs
+func (s *Server) loginCsrf(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(consoleLoginCookie); err == nil && len(cookie.Value) == common.TokenLength {
+		return cookie.Value
+	}
+
+	token := common.GenerateToken()
+	s.setCookie(w, r, consoleLoginCookie, "/console/login", token, time.Now().Add(consoleLoginTTL))
+
+	return token
+}
+
+func (s *Server) renderConsoleLogin(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	s.renderConsole(w, r, status, "login", consolePage{
+		Title: "Log in",
+		Error: msg,
+		Data:  consoleLoginData{Csrf: s.loginCsrf(w, r)},
+	})
+}
+
+func (s *Server) HandleConsoleLoginPage(w http.ResponseWriter, r *http.Request) {
+	s.renderConsoleLogin(w, r, http.StatusOK, "")
+}
+
+func (s *Server) HandleConsoleLogin(w http.ResponseWriter, r *http.Request) {
+	fail := func(status int, msg string) {
+		s.renderConsoleLogin(w, r, status, msg)
+	}
+
+	// a login posted from another site would sign the victim in as the attacker
+	cookie, err := r.Cookie(consoleLoginCookie)
+
+	if err != nil || subtle.ConstantTimeCompare([]byte(r.PostFormValue("csrf")), []byte(cookie.Value)) != 1 {
+		fail(http.StatusForbidden, "The login form has expired, please try again")
+		return
+	}
+
+	data, err := s.db.CheckAuthValid(r.Context(), strings.TrimSpace(r.PostFormValue("token")))
+
+	if err != nil && errors.Is(err, database.ErrDefaultToken) {
+		metrics.AuthFailures.WithLabelValues(metrics.AuthDefaultToken).Inc()
+		fail(http.StatusForbidden, "The default admin token cannot be used, create an admin with `scraper admin bootstrap`")
+		return
+	}
+
+	if err != nil && errors.Is(err, database.ErrTokenExpired) {
+		metrics.AuthFailures.WithLabelValues(metrics.AuthExpired).Inc()
+		fail(http.StatusUnauthorized, "This token has expired")
+		return
+	}
+
+	if err != nil {
+		LoggerFromContext(r.Context()).Named("console").Error("error checking auth", zap.Error(err))
+		fail(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	if !data.Valid {
+		metrics.AuthFailures.WithLabelValues(metrics.AuthInvalid).Inc()
+		fail(http.StatusUnauthorized, "Invalid token")
+		return
+	}
+
+	session, id, err := s.db.CreateSession(r.Context(), data.UserId, consoleSessionTTL)
+
+	if err != nil {
+		LoggerFromContext(r.Context()).Named("console").Error("could not create session", zap.Error(err))
+		fail(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	s.db.MarkUsed(data.UserId)
+	s.setCookie(w, r, consoleLoginCookie, "/console/login", "", time.Unix(0, 0))
+	s.setConsoleCookie(w, r, id, session.ExpiresAt)
+	http.Redirect(w, r, "/console", http.StatusSeeOther)
+}
+
+func (s *Server) HandleConsoleLogout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(consoleCookie); err == nil {
+		if err := s.db.DeleteSession(r.Context(), cookie.Value); err != nil {
+			LoggerFromContext(r.Context()).Named("console").Error("could not delete session", zap.Error(err))
+		}
+	}
+
+	s.clearConsoleCookie(w, r)
+	http.Redirect(w, r, "/console/login", http.StatusSeeOther)
+}
+
+func (s *Server) HandleConsoleStatus(w http.ResponseWriter, r *http.Request) {
+	principal, _ := PrincipalFromContext(r.Context())
+
+	count, err := s.db.CountFingerprints(r.Context())
+
+	if err != nil {
+		LoggerFromContext(r.Context()).Named("console").Error("could not count fingerprints", zap.Error(err))
+		s.renderConsoleError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	data := consoleStatusData{
+		Count:       count,
+		Permissions: principal.Permissions.String(),
+		ShowProxies: s.pm != nil && principal.Permissions.Has(common.PermissionViewProxies),
+	}
+
+	if data.ShowProxies {
+		data.Proxies = s.pm.IPs()
+	}
+
+	if principal.Permissions.Has(common.PermissionManageUsers) {
+		users, err := s.db.GetAllUsers(r.Context())
+
+		if err != nil {
+			LoggerFromContext(r.Context()).Named("console").Error("could not list users", zap.Error(err))
+			s.renderConsoleError(w, r, http.StatusInternalServerError)
+			return
+		}
+
+		data.Users = len(users)
+	}
+
+	s.renderConsole(w, r, http.StatusOK, "status", consolePage{Title: "Status", Data: data})
+}
+
+func (s *Server) renderConsoleUsers(w http.ResponseWriter, r *http.Request, page consolePage) {
+	users, err := s.db.GetAllUsers(r.Context())
+
+	if err != nil {
+		LoggerFromContext(r.Context()).Named("console").Error("could not list users", zap.Error(err))
+		s.renderConsoleError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	data, _ := page.Data.(consoleUsersData)
+	data.Users = NewRenderUserData(users)
+	// only offer the permissions the caller could grant
+	principal, _ := PrincipalFromContext(r.Context())
+	data.Permissions = principal.Permissions.List()
+
+	page.Title = "Users"
+	page.Data = data
+
+	status := http.StatusOK
+
+	if page.Error != "" {
+		status = http.StatusBadRequest
+	}
+
+	s.renderConsole(w, r, status, "users", page)
+}
+
+func (s *Server) HandleConsoleUsers(w http.ResponseWriter, r *http.Request) {
+	s.renderConsoleUsers(w, r, consolePage{})
+}
+
+func (s *Server) HandleConsoleCreateUser(w http.ResponseWriter, r *http.Request) {
+	permissions, err := common.ParsePermissions(strings.Join(r.PostForm["permissions"], ","))
+
+	if err != nil {
+		s.renderConsoleUsers(w, r, consolePage{Error: err.Error()})
+		return
+	}
+
+	if !canManage(r, permissions) {
+		s.renderConsoleUsers(w, r, consolePage{Error: "You cannot grant permissions you do not hold"})
+		return
+	}
+
+	options := database.CreateUserOptions{
+		Permissions: permissions,
+		Label:       strings.TrimSpace(r.PostFormValue("label")),
+	}
+
+	if value := r.PostFormValue("expires_at"); value != "" {
+		expiresAt, err := time.ParseInLocation(datetimeLocalFormat, value, time.UTC)
+
+		if err != nil || !expiresAt.After(time.Now()) {
+			s.renderConsoleUsers(w, r, consolePage{Error: "Expiry must be a time in the future"})
+			return
+		}
+
+		options.ExpiresAt = &expiresAt
+	}
+
+	user, token, err := s.db.CreateUser(r.Context(), options)
+
+	if err != nil {
+		LoggerFromContext(r.Context()).Named("console").Error("could not create user", zap.Error(err))
+		s.renderConsoleError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	s.renderConsoleUsers(w, r, consolePage{
+		Flash: fmt.Sprintf("Created user %d", user.UserId),
+		Data:  consoleUsersData{NewToken: token, NewTokenUser: user.UserId},
+	})
+}
+
+func (s *Server) HandleConsoleRotateToken(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseUserId(r)
+
+	if !ok {
+		s.renderConsoleError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	allowed, err := s.canManageUser(r, id)
+
+	if err == nil && !allowed {
+		s.renderConsoleError(w, r, http.StatusForbidden)
+		return
+	}
+
+	var user database.GetUserResult
+	var token string
+
+	if err == nil {
+		user, token, err = s.db.RotateToken(r.Context(), id)
+	}
+
+	if err != nil && errors.Is(err, database.ErrUserNotFound) {
+		s.renderConsoleError(w, r, http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		LoggerFromContext(r.Context()).Named("console").Error("could not rotate token", zap.Error(err))
+		s.renderConsoleError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	// rotating your own token ends your session along with the others
+	if principal, _ := PrincipalFromContext(r.Context()); principal.UserId == id {
+		s.clearConsoleCookie(w, r)
+	}
+
+	s.renderConsoleUsers(w, r, consolePage{
+		Flash: fmt.Sprintf("Rotated the token of user %d", user.UserId),
+		Data:  consoleUsersData{NewToken: token, NewTokenUser: user.UserId},
+	})
+}
+
+func (s *Server) HandleConsoleRevokeUser(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseUserId(r)
+
+	if !ok {
+		s.renderConsoleError(w, r, http.StatusBadRequest)
+		return
+	}
+
+	if principal, _ := PrincipalFromContext(r.Context()); principal.UserId == id {
+		s.renderConsoleUsers(w, r, consolePage{Error: "You cannot revoke your own token"})
+		return
+	}
+
+	allowed, err := s.canManageUser(r, id)
+
+	if err == nil && !allowed {
+		s.renderConsoleError(w, r, http.StatusForbidden)
+		return
+	}
+
+	if err == nil {
+		err = s.db.RevokeUser(r.Context(), id)
+	}
+
+	if err != nil && errors.Is(err, database.ErrUserNotFound) {
+		s.renderConsoleError(w, r, http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		LoggerFromContext(r.Context()).Named("console").Error("could not revoke user", zap.Error(err))
+		s.renderConsoleError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/console/users", http.StatusSeeOther)
+}
+
+func (s *Server) HandleConsoleAudit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	data := consoleAuditData{
+		Since:  query.Get("since"),
+		Until:  query.Get("until"),
+		UserId: query.Get("user_id"),
+	}
+
+	filter := database.AuditLogFilter{Limit: defaultAuditLogLimit}
+	page := consolePage{Title: "Audit log", Data: &data}
+
+	parse := func(value string) (*time.Time, bool) {
+		if value == "" {
+			return nil, true
+		}
+
+		parsed, err := time.ParseInLocation(datetimeLocalFormat, value, time.UTC)
+		return &parsed, err == nil
+	}
+
+	var ok bool
+
+	if filter.Since, ok = parse(data.Since); !ok {
+		page.Error = "Since is not a valid time"
+	}
+
+	if filter.Until, ok = parse(data.Until); !ok {
+		page.Error = "Until is not a valid time"
+	}
+
+	if data.UserId != "" {
+		id, err := strconv.ParseUint(data.UserId, 10, 64)
+
+		if err != nil {
+			page.Error = "User id must be a number"
+		}
+
+		filter.UserId = &id
+	}
+
+	if page.Error != "" {
+		s.renderConsole(w, r, http.StatusBadRequest, "audit", page)
+		return
+	}
+
+	entries, err := s.db.GetAuditLog(r.Context(), filter)
+
+	if err != nil {
+		LoggerFromContext(r.Context()).Named("console").Error("could not read audit log", zap.Error(err))
+		s.renderConsoleError(w, r, http.StatusInternalServerError)
+		return
+	}
+
+	data.Entries = entries
+
+	s.renderConsole(w, r, http.StatusOK, "audit", page)
+}
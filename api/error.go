@@ -1,42 +1,115 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/database"
 	"go.uber.org/zap"
 )
 
-func WriteError(w http.ResponseWriter, msg string, code *string, status int) {
-	data, err := json.Marshal(ErrorResponse{
-		Error: msg,
-		Code:  code,
-	})
+// Error is an entry in the error catalog: a stable, machine readable code along
+// with the status and message sent for it. Codes must never change once added,
+// clients match on them.
+type Error struct {
+	Code    string
+	Status  int
+	Message string
+}
 
-	if err != nil {
+func (e Error) Error() string {
+	return e.Message
+}
 
-		data, err := json.Marshal(ErrorResponse{
-			Error: "Internal Server Error",
-		})
+// WithMessage returns the error with more detail appended to its message,
+// keeping the code and status
+func (e Error) WithMessage(detail string) Error {
+	e.Message = fmt.Sprintf("%s: %s", e.Message, detail)
+	return e
+}
 
-		if err != nil {
-			zap.S().Named("api.error.write").Error(err.Error())
+var (
+	ErrBadRequest         = Error{Code: "bad_request", Status: http.StatusBadRequest, Message: "Bad Request"}
+	ErrUnauthorized       = Error{Code: "unauthorized", Status: http.StatusUnauthorized, Message: "Unauthorized"}
+	ErrTokenExpired       = Error{Code: "token_expired", Status: http.StatusUnauthorized, Message: "Unauthorized: token has expired"}
+	ErrForbidden          = Error{Code: "forbidden", Status: http.StatusForbidden, Message: "Forbidden"}
+	ErrDefaultCredentials = Error{Code: "default_credentails_insecure", Status: http.StatusForbidden, Message: "Security: the default admin token must not be used - remove it and create an admin with `scraper admin bootstrap`"}
+	ErrNotFound           = Error{Code: "not_found", Status: http.StatusNotFound, Message: "Not Found"}
+	ErrNoFingerprints     = Error{Code: "no_fingerprints", Status: http.StatusNotFound, Message: "No Fingerprints"}
+	ErrMethodNotAllowed   = Error{Code: "method_not_allowed", Status: http.StatusMethodNotAllowed, Message: "Method Not Allowed"}
+	ErrConflict           = Error{Code: "conflict", Status: http.StatusConflict, Message: "Conflict"}
+	ErrRateLimited        = Error{Code: "rate_limited", Status: http.StatusTooManyRequests, Message: "Too Many Requests"}
+	ErrDatabaseTimeout    = Error{Code: "database_timeout", Status: http.StatusGatewayTimeout, Message: "Gateway Timeout: the database did not respond in time"}
+	ErrInternal           = Error{Code: "internal_error", Status: http.StatusInternalServerError, Message: "Internal Server Error"}
+)
 
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("internal server error"))
-			return
-		}
+// ErrorCatalog is every error the api can respond with
+var ErrorCatalog = []Error{
+	ErrBadRequest,
+	ErrUnauthorized,
+	ErrTokenExpired,
+	ErrForbidden,
+	ErrDefaultCredentials,
+	ErrNotFound,
+	ErrNoFingerprints,
+	ErrMethodNotAllowed,
+	ErrConflict,
+	ErrRateLimited,
+	ErrDatabaseTimeout,
+	ErrInternal,
+}
 
-		w.WriteHeader(status)
-		w.Write(data)
+// WriteError responds with e. If cause is not nil it is logged alongside the
+// request id, it is never sent to the client. An internal error caused by a
+// query timing out is sent as ErrDatabaseTimeout instead, so clients know that
+// retrying may work.
+func WriteError(w http.ResponseWriter, r *http.Request, e Error, cause error) {
+	if e.Code == ErrInternal.Code && database.IsTimeout(cause) {
+		e = ErrDatabaseTimeout
+	}
 
+	// the client hung up and cancelled its queries, there is nobody to tell
+	if errors.Is(cause, context.Canceled) && r.Context().Err() != nil {
+		LoggerFromContext(r.Context()).Debug("request cancelled", zap.NamedError("cause", cause))
+		writeError(w, e)
 		return
 	}
 
-	w.WriteHeader(status)
-	w.Write(data)
+	if cause != nil || e.Status >= http.StatusInternalServerError {
+		LoggerFromContext(r.Context()).Error(
+			e.Message,
+			zap.String("code", e.Code),
+			zap.String("method", r.Method),
+			zap.String("path", r.URL.Path),
+			zap.NamedError("cause", cause),
+		)
+	}
+
+	writeError(w, e)
 }
 
-func WriteBadRequest(w http.ResponseWriter) {
-	WriteError(w, "Bad Request", nil, http.StatusBadRequest)
+// writeError responds with e without logging anything, for callers that have
+// already logged the cause themselves
+func writeError(w http.ResponseWriter, e Error) {
+	data, err := json.Marshal(ErrorResponse{
+		Error:     e.Message,
+		Code:      e.Code,
+		RequestID: requestID(w),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err != nil {
+		zap.S().Named("api.error.write").Error(err.Error())
+
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"message":"Internal Server Error","code":"internal_error"}`))
+		return
+	}
+
+	w.WriteHeader(e.Status)
+	w.Write(data)
 }
@@ -0,0 +1,242 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/database"
+	"go.uber.org/zap"
+)
+
+// how many rows are written between flushes
+const exportFlushEvery = 500
+
+type exportFormat struct {
+	Name        string
+	ContentType string
+	Extension   string
+	newWriter   func(w io.Writer) exportWriter
+}
+
+type exportWriter interface {
+	Begin() error
+	Write(fp database.GetFingerprintResult) error
+	// Flush writes out anything the writer has buffered
+	Flush() error
+}
+
+// in the order they are preferred when the Accept header allows several
+var exportFormats = []exportFormat{
+	{Name: "ndjson", ContentType: "application/x-ndjson", Extension: "ndjson", newWriter: newNDJSONExportWriter},
+	{Name: "csv", ContentType: "text/csv", Extension: "csv", newWriter: newCSVExportWriter},
+	{Name: "text", ContentType: "text/plain", Extension: "txt", newWriter: newTextExportWriter},
+}
+
+func findExportFormat(name string) (exportFormat, bool) {
+	for _, format := range exportFormats {
+		if format.Name == name {
+			return format, true
+		}
+	}
+
+	return exportFormat{}, false
+}
+
+// negotiateExportFormat picks the format from the format query parameter, then
+// the Accept header, falling back to the given default
+func negotiateExportFormat(r *http.Request, fallback string) (exportFormat, bool) {
+	if name := r.URL.Query().Get("format"); name != "" {
+		return findExportFormat(name)
+	}
+
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+
+		if err != nil {
+			continue
+		}
+
+		for _, format := range exportFormats {
+			if format.ContentType == mediaType {
+				return format, true
+			}
+		}
+	}
+
+	return findExportFormat(fallback)
+}
+
+type ndjsonExportWriter struct {
+	encoder *json.Encoder
+}
+
+func newNDJSONExportWriter(w io.Writer) exportWriter {
+	return &ndjsonExportWriter{encoder: json.NewEncoder(w)}
+}
+
+func (e *ndjsonExportWriter) Begin() error {
+	return nil
+}
+
+func (e *ndjsonExportWriter) Write(fp database.GetFingerprintResult) error {
+	// Encode terminates every value with a newline
+	return e.encoder.Encode(GetFingerprintResponse{
+		ID:          fp.ID,
+		Fingerprint: fp.Fingerprint,
+		ProxyIP:     fp.ProxyIP,
+		CreatedAt:   fp.CreatedAt,
+	})
+}
+
+func (e *ndjsonExportWriter) Flush() error {
+	return nil
+}
+
+type csvExportWriter struct {
+	writer *csv.Writer
+}
+
+func newCSVExportWriter(w io.Writer) exportWriter {
+	return &csvExportWriter{writer: csv.NewWriter(w)}
+}
+
+func (e *csvExportWriter) Begin() error {
+	return e.writer.Write([]string{"id", "fingerprint", "proxy_ip", "created_at"})
+}
+
+func (e *csvExportWriter) Write(fp database.GetFingerprintResult) error {
+	createdAt := ""
+
+	if fp.CreatedAt != nil {
+		createdAt = fp.CreatedAt.UTC().Format(time.RFC3339)
+	}
+
+	return e.writer.Write([]string{
+		strconv.FormatUint(fp.ID, 10),
+		fp.Fingerprint,
+		fp.ProxyIP,
+		createdAt,
+	})
+}
+
+func (e *csvExportWriter) Flush() error {
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+type textExportWriter struct {
+	w io.Writer
+}
+
+func newTextExportWriter(w io.Writer) exportWriter {
+	return &textExportWriter{w: w}
+}
+
+func (e *textExportWriter) Begin() error {
+	return nil
+}
+
+func (e *textExportWriter) Write(fp database.GetFingerprintResult) error {
+	_, err := fmt.Fprintf(e.w, "%s\n", fp.Fingerprint)
+	return err
+}
+
+func (e *textExportWriter) Flush() error {
+	return nil
+}
+
+func (s *Server) streamExport(w http.ResponseWriter, r *http.Request, format exportFormat) {
+	log := LoggerFromContext(r.Context()).Named("export").With(zap.String("format", format.Name))
+	writer := format.newWriter(w)
+	responseFlusher, canFlush := w.(http.Flusher)
+
+	started := false
+	written := 0
+
+	begin := func() error {
+		started = true
+
+		w.Header().Set("Content-Type", format.ContentType+"; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"fingerprints.%s\"", format.Extension))
+		w.WriteHeader(http.StatusOK)
+
+		return writer.Begin()
+	}
+
+	err := s.db.StreamFingerprints(r.Context(), func(fp database.GetFingerprintResult) error {
+		if !started {
+			if err := begin(); err != nil {
+				return err
+			}
+		}
+
+		if err := writer.Write(fp); err != nil {
+			return err
+		}
+
+		written++
+
+		if written%exportFlushEvery == 0 {
+			if err := writer.Flush(); err != nil {
+				return err
+			}
+
+			if canFlush {
+				responseFlusher.Flush()
+			}
+		}
+
+		// stop reading rows as soon as the client has gone
+		return r.Context().Err()
+	})
+
+	if err != nil && r.Context().Err() != nil {
+		log.Debug("client went away during export", zap.Int("rows", written))
+		return
+	}
+
+	if err != nil && !started {
+		WriteError(w, r, ErrInternal, err)
+		return
+	}
+
+	if err != nil {
+		// the status has already been sent, so all that can be done is to stop
+		log.Error("export failed part way through", zap.Int("rows", written), zap.Error(err))
+		return
+	}
+
+	if !started {
+		if err := begin(); err != nil {
+			log.Error(err.Error())
+			return
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		log.Error(err.Error())
+	}
+}
+
+func (s *Server) HandleExportFingerprints(w http.ResponseWriter, r *http.Request) {
+	format, ok := negotiateExportFormat(r, "ndjson")
+
+	if !ok {
+		WriteError(w, r, ErrBadRequest.WithMessage("format must be one of ndjson, csv, text"), nil)
+		return
+	}
+
+	s.streamExport(w, r, format)
+}
+
+func (s *Server) HandleGetAllFingerprintsRaw(w http.ResponseWriter, r *http.Request) {
+	format, _ := findExportFormat("text")
+	s.streamExport(w, r, format)
+}
@@ -0,0 +1,84 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/database"
+)
+
+func TestNegotiateExportFormat(t *testing.T) {
+	cases := []struct {
+		url    string
+		accept string
+		want   string
+		ok     bool
+	}{
+		{"/export", "", "ndjson", true},
+		{"/export?format=csv", "application/x-ndjson", "csv", true},
+		{"/export", "text/csv", "csv", true},
+		{"/export", "text/html, text/plain;q=0.9", "text", true},
+		{"/export", "*/*", "ndjson", true},
+		{"/export?format=xml", "", "", false},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, c.url, nil)
+
+		if c.accept != "" {
+			r.Header.Set("Accept", c.accept)
+		}
+
+		format, ok := negotiateExportFormat(r, "ndjson")
+
+		if ok != c.ok || format.Name != c.want {
+			t.Errorf("%s (Accept: %s): expected %q/%v, got %q/%v", c.url, c.accept, c.want, c.ok, format.Name, ok)
+		}
+	}
+}
+
+func TestExportWriters(t *testing.T) {
+	second := time.Date(2023, 12, 18, 10, 0, 0, 0, time.UTC)
+	first := time.Date(2023, 12, 17, 9, 30, 0, 0, time.UTC)
+
+	// the last was fetched before the time was recorded
+	rows := []database.GetFingerprintResult{
+		{ID: 3, Fingerprint: "b.fp", ProxyIP: "127.0.0.1:8080", CreatedAt: &second},
+		{ID: 2, Fingerprint: "a,fp", ProxyIP: "127.0.0.1:8081", CreatedAt: &first},
+		{ID: 1, Fingerprint: "c.fp", ProxyIP: "127.0.0.1:8081"},
+	}
+
+	expected := map[string]string{
+		"ndjson": "{\"id\":3,\"fingerprint\":\"b.fp\",\"proxy_ip\":\"127.0.0.1:8080\",\"created_at\":\"2023-12-18T10:00:00Z\"}\n{\"id\":2,\"fingerprint\":\"a,fp\",\"proxy_ip\":\"127.0.0.1:8081\",\"created_at\":\"2023-12-17T09:30:00Z\"}\n{\"id\":1,\"fingerprint\":\"c.fp\",\"proxy_ip\":\"127.0.0.1:8081\",\"created_at\":null}\n",
+		"csv":    "id,fingerprint,proxy_ip,created_at\n3,b.fp,127.0.0.1:8080,2023-12-18T10:00:00Z\n2,\"a,fp\",127.0.0.1:8081,2023-12-17T09:30:00Z\n1,c.fp,127.0.0.1:8081,\n",
+		"text":   "b.fp\na,fp\nc.fp\n",
+	}
+
+	for name, want := range expected {
+		format, _ := findExportFormat(name)
+
+		var out bytes.Buffer
+		writer := format.newWriter(&out)
+
+		if err := writer.Begin(); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, row := range rows {
+			if err := writer.Write(row); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := writer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		if out.String() != want {
+			t.Errorf("%s: expected %q, got %q", name, want, out.String())
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/migrate"
+)
+
+// how long the database has to answer a readiness check
+const readyTimeout = time.Second * 2
+
+// HandleHealthz reports that the process is up and serving, it never checks
+// anything outside of it
+func (s *Server) HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	WriteJSON(w, r, HealthResponse{Status: "ok"}, http.StatusOK)
+}
+
+// HandleReadyz reports whether this instance should be sent traffic, with the
+// result of every check. It responds 503 if any of them failed.
+func (s *Server) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	checks := map[string]ReadyCheck{
+		"server":     s.checkServer(),
+		"database":   s.checkDatabase(ctx),
+		"migrations": s.checkMigrations(ctx),
+	}
+
+	out := HealthResponse{Status: "ok", Checks: checks}
+	status := http.StatusOK
+
+	for _, check := range checks {
+		if !check.OK {
+			out.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	WriteJSON(w, r, out, status)
+}
+
+func (s *Server) checkServer() ReadyCheck {
+	if s.shuttingDown.Load() {
+		return ReadyCheck{OK: false, Error: "shutting down"}
+	}
+
+	return ReadyCheck{OK: true}
+}
+
+func (s *Server) checkDatabase(ctx context.Context) ReadyCheck {
+	if s.db == nil {
+		return ReadyCheck{OK: false, Error: "no database configured"}
+	}
+
+	start := time.Now()
+	err := s.db.Ping(ctx)
+	check := ReadyCheck{OK: err == nil, Duration: time.Since(start).String()}
+
+	if err != nil {
+		check.Error = err.Error()
+	}
+
+	return check
+}
+
+func (s *Server) checkMigrations(ctx context.Context) ReadyCheck {
+	expected, err := migrate.LatestVersion()
+
+	if err != nil {
+		return ReadyCheck{OK: false, Error: err.Error()}
+	}
+
+	check := ReadyCheck{Expected: &expected}
+
+	if s.db == nil {
+		check.Error = "no database configured"
+		return check
+	}
+
+	version, err := s.db.MigrationVersion(ctx)
+
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+
+	check.Version = &version
+	check.OK = version == expected
+
+	if !check.OK {
+		check.Error = fmt.Sprintf("database is at version %d, expected %d", version, expected)
+	}
+
+	return check
+}
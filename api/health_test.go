@@ -0,0 +1,102 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/database"
+)
+
+func TestHealthzNeedsNoToken(t *testing.T) {
+	s := NewServer(NewServerOptions{})
+	s.InitRoutes()
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+}
+
+func TestReadyzReportsFailedChecks(t *testing.T) {
+	s := NewServer(NewServerOptions{})
+	s.InitRoutes()
+	s.Shutdown(context.Background())
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", w.Code)
+	}
+
+	var body HealthResponse
+
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"server", "database", "migrations"} {
+		check, ok := body.Checks[name]
+
+		if !ok || check.OK || check.Error == "" {
+			t.Errorf("expected %s to be reported as failed, got %+v", name, check)
+		}
+	}
+
+	if body.Checks["migrations"].Expected == nil {
+		t.Error("expected the migrations check to report the expected version")
+	}
+}
+
+// probes only see the server shutting down if it keeps listening for a while
+func TestReadyzFailsWhileDraining(t *testing.T) {
+	s := NewServer(NewServerOptions{Store: database.NewMemoryStore(), DrainDelay: time.Millisecond * 200})
+	s.InitRoutes()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go s.serve(listener)
+
+	status := func() int {
+		t.Helper()
+
+		resp, err := http.Get("http://" + listener.Addr().String() + "/readyz")
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if got := status(); got != http.StatusOK {
+		t.Fatalf("expected 200 before shutting down, got %d", got)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.Shutdown(context.Background()) }()
+
+	for !s.shuttingDown.Load() {
+		time.Sleep(time.Millisecond)
+	}
+
+	if got := status(); got != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 while draining, got %d", got)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
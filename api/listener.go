@@ -0,0 +1,235 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// how often the certificate files are checked for changes, at most
+const certReloadInterval = time.Second * 10
+
+// ListenerOptions configures where and how the server accepts connections. The
+// zero value is plain http on the tcp port.
+type ListenerOptions struct {
+	// listen on this unix socket instead of the tcp port, for use behind a
+	// reverse proxy on the same host
+	Socket string
+
+	// serve https with this certificate and key, both are reloaded when
+	// either file changes
+	TLSCert string
+	TLSKey  string
+
+	// verify client certificates against the CAs in this file, a verified
+	// certificate authenticates as the user its subject is mapped to.
+	// Requires TLSCert and TLSKey.
+	ClientCA string
+}
+
+func (o ListenerOptions) tls() bool {
+	return o.TLSCert != "" || o.TLSKey != ""
+}
+
+// listen opens the listener described by the server's options, configuring
+// tls on the http server if it is enabled
+func (s *Server) listen() (net.Listener, error) {
+	options := s.listener
+
+	if options.tls() && (options.TLSCert == "" || options.TLSKey == "") {
+		return nil, errors.New("both a tls certificate and key must be given")
+	}
+
+	if options.ClientCA != "" && !options.tls() {
+		return nil, errors.New("client certificates require tls")
+	}
+
+	if options.tls() {
+		config, err := newTLSConfig(options)
+
+		if err != nil {
+			return nil, err
+		}
+
+		s.http.TLSConfig = config
+	}
+
+	if options.Socket == "" {
+		return net.Listen("tcp", s.http.Addr)
+	}
+
+	// a socket left behind by an unclean exit would make the listen fail
+	if info, err := os.Lstat(options.Socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(options.Socket); err != nil {
+			return nil, fmt.Errorf("removing stale socket: %w", err)
+		}
+	}
+
+	return net.Listen("unix", options.Socket)
+}
+
+func (s *Server) serve(listener net.Listener) error {
+	if s.http.TLSConfig != nil {
+		// the certificate comes from TLSConfig.GetCertificate
+		return s.http.ServeTLS(listener, "", "")
+	}
+
+	return s.http.Serve(listener)
+}
+
+func (s *Server) address() string {
+	scheme := "http"
+
+	if s.listener.tls() {
+		scheme = "https"
+	}
+
+	if s.listener.Socket != "" {
+		return fmt.Sprintf("%s+unix://%s", scheme, s.listener.Socket)
+	}
+
+	return fmt.Sprintf("%s://localhost:%d", scheme, s.port)
+}
+
+func newTLSConfig(options ListenerOptions) (*tls.Config, error) {
+	reloader, err := newCertReloader(options.TLSCert, options.TLSKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if options.ClientCA != "" {
+		pem, err := os.ReadFile(options.ClientCA)
+
+		if err != nil {
+			return nil, fmt.Errorf("reading client ca: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("client ca file contains no certificates")
+		}
+
+		// tokens still work, so a certificate is optional, but one that is
+		// given must verify
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return config, nil
+}
+
+// clientCertSubject returns the subject of the verified client certificate
+// the request was made with, if there is one
+func clientCertSubject(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+
+	return r.TLS.VerifiedChains[0][0].Subject.String(), true
+}
+
+// certReloader serves a certificate and key pair from disk, loading them
+// again when either file is modified
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	c := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	modTime, err := c.latestModTime()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// fail at startup rather than on the first handshake
+	if err := c.load(modTime); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+
+	for _, file := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(file)
+
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+
+	return latest, nil
+}
+
+func (c *certReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+
+	if err != nil {
+		return err
+	}
+
+	c.cert = &cert
+	c.modTime = modTime
+	c.checked = time.Now()
+
+	return nil
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checked) < certReloadInterval {
+		return c.cert, nil
+	}
+
+	c.checked = time.Now()
+	modTime, err := c.latestModTime()
+
+	if err != nil || !modTime.After(c.modTime) {
+		return c.cert, nil
+	}
+
+	log := zap.L().Named("api.tls")
+
+	// the files may be mid-write, keep serving the old pair until both load
+	if err := c.load(modTime); err != nil {
+		log.Warn("could not reload certificate, keeping the previous one", zap.Error(err))
+		return c.cert, nil
+	}
+
+	log.Info("reloaded certificate", zap.String("cert", c.certFile))
+	return c.cert, nil
+}
@@ -0,0 +1,181 @@
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertPair writes a self-signed certificate for commonName and its key
+// into dir, returning their paths
+func writeCertPair(t *testing.T, dir string, commonName string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func servedCommonName(t *testing.T, reloader *certReloader) string {
+	t.Helper()
+
+	cert, err := reloader.GetCertificate(&tls.ClientHelloInfo{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloaderPicksUpChanges(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCertPair(t, dir, "first")
+
+	reloader, err := newCertReloader(certFile, keyFile)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name := servedCommonName(t, reloader); name != "first" {
+		t.Fatalf("expected first, got %s", name)
+	}
+
+	writeCertPair(t, dir, "second")
+
+	// file systems with coarse timestamps could otherwise see no change
+	later := time.Now().Add(time.Minute)
+
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.Chtimes(file, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// within the interval the files are not looked at again
+	if name := servedCommonName(t, reloader); name != "first" {
+		t.Fatalf("expected first before the reload interval, got %s", name)
+	}
+
+	reloader.checked = time.Time{}
+
+	if name := servedCommonName(t, reloader); name != "second" {
+		t.Fatalf("expected second after reloading, got %s", name)
+	}
+}
+
+func TestServerListensOnUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "api.sock")
+
+	s := NewServer(NewServerOptions{Listener: ListenerOptions{Socket: socket}})
+	s.InitRoutes()
+
+	done := make(chan error, 1)
+	go func() { done <- s.Run() }()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+
+	var resp *http.Response
+	var err error
+
+	// the listener is opened in the background
+	for i := 0; i < 50; i++ {
+		resp, err = client.Get("http://unix" + APIPrefix + "/openapi.json")
+
+		if err == nil {
+			break
+		}
+
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200, got %d", resp.StatusCode)
+	}
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("expected a clean exit, got %s", err)
+	}
+
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("expected the socket to be removed, got %v", err)
+	}
+}
+
+func TestClientCertificatesRequireTLS(t *testing.T) {
+	s := NewServer(NewServerOptions{Listener: ListenerOptions{ClientCA: "ca.pem"}})
+
+	if err := s.Run(); err == nil {
+		t.Fatal("expected an error")
+	}
+}
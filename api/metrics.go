@@ -0,0 +1,107 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/database"
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// newMetricsHandler serves the collectors in the metrics package, along with
+// the go runtime, the process and, if there is one, the database
+func newMetricsHandler(db database.Store) http.Handler {
+	registry := prometheus.NewRegistry()
+
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	registry.MustRegister(metrics.Collectors()...)
+
+	if db != nil {
+		registry.MustRegister(newDatabaseCollector(db))
+	}
+
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// HandleMetrics serves the metrics in the prometheus text format. If a
+// metrics token is configured it must be sent as a bearer token.
+func (s *Server) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	if s.metricsToken != "" {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		if subtle.ConstantTimeCompare([]byte(given), []byte(s.metricsToken)) != 1 {
+			WriteError(w, r, ErrUnauthorized, nil)
+			return
+		}
+	}
+
+	s.metricsHandler.ServeHTTP(w, r)
+}
+
+// databaseCollector reads the pool and listener statistics when scraped, so
+// they never go stale between scrapes
+type databaseCollector struct {
+	db database.Store
+
+	totalConns    *prometheus.Desc
+	idleConns     *prometheus.Desc
+	acquiredConns *prometheus.Desc
+	maxConns      *prometheus.Desc
+	acquireCount  *prometheus.Desc
+	acquireWait   *prometheus.Desc
+
+	inserted     *prometheus.Desc
+	insertErrors *prometheus.Desc
+}
+
+func newDatabaseCollector(db database.Store) *databaseCollector {
+	desc := func(name string, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName("scraper", "", name), help, nil, nil)
+	}
+
+	return &databaseCollector{
+		db: db,
+
+		totalConns:    desc("db_pool_total_conns", "Connections currently open in the pool."),
+		idleConns:     desc("db_pool_idle_conns", "Connections currently idle in the pool."),
+		acquiredConns: desc("db_pool_acquired_conns", "Connections currently in use."),
+		maxConns:      desc("db_pool_max_conns", "The most connections the pool will open."),
+		acquireCount:  desc("db_pool_acquires_total", "Connections acquired from the pool."),
+		acquireWait:   desc("db_pool_acquire_seconds_total", "Time spent acquiring connections from the pool."),
+
+		inserted:     desc("fingerprints_inserted_total", "Fingerprints stored by the listener since this process started."),
+		insertErrors: desc("fingerprints_insert_errors_total", "Fingerprints the listener failed to store since this process started."),
+	}
+}
+
+func (c *databaseCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.totalConns
+	ch <- c.idleConns
+	ch <- c.acquiredConns
+	ch <- c.maxConns
+	ch <- c.acquireCount
+	ch <- c.acquireWait
+	ch <- c.inserted
+	ch <- c.insertErrors
+}
+
+func (c *databaseCollector) Collect(ch chan<- prometheus.Metric) {
+	pool := c.db.PoolStats()
+	inserts := c.db.InsertStats()
+
+	ch <- prometheus.MustNewConstMetric(c.totalConns, prometheus.GaugeValue, float64(pool.TotalConns))
+	ch <- prometheus.MustNewConstMetric(c.idleConns, prometheus.GaugeValue, float64(pool.IdleConns))
+	ch <- prometheus.MustNewConstMetric(c.acquiredConns, prometheus.GaugeValue, float64(pool.AcquiredConns))
+	ch <- prometheus.MustNewConstMetric(c.maxConns, prometheus.GaugeValue, float64(pool.MaxConns))
+	ch <- prometheus.MustNewConstMetric(c.acquireCount, prometheus.CounterValue, float64(pool.AcquireCount))
+	ch <- prometheus.MustNewConstMetric(c.acquireWait, prometheus.CounterValue, pool.AcquireWait.Seconds())
+	ch <- prometheus.MustNewConstMetric(c.inserted, prometheus.CounterValue, float64(inserts.Inserted))
+	ch <- prometheus.MustNewConstMetric(c.insertErrors, prometheus.CounterValue, float64(inserts.Failed))
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsCountsRequestsByRoute(t *testing.T) {
+	s := NewServer(NewServerOptions{})
+	s.InitRoutes()
+
+	s.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	expected := `scraper_http_requests_total{method="GET",route="/healthz",status="200"}`
+
+	if !strings.Contains(w.Body.String(), expected) {
+		t.Errorf("expected the metrics to contain %s", expected)
+	}
+}
+
+func TestMetricsGroupsUnknownMethods(t *testing.T) {
+	s := NewServer(NewServerOptions{})
+	s.InitRoutes()
+
+	s.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("MADEUP", "/healthz", nil))
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if strings.Contains(w.Body.String(), `method="MADEUP"`) {
+		t.Error("expected the made up method not to be a label value")
+	}
+
+	if !strings.Contains(w.Body.String(), `method="other"`) {
+		t.Error("expected the made up method to be counted as other")
+	}
+}
+
+func TestMetricsToken(t *testing.T) {
+	s := NewServer(NewServerOptions{MetricsToken: "secret"})
+	s.InitRoutes()
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without the token, got %d", w.Code)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+
+	w = httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 with the token, got %d", w.Code)
+	}
+}
@@ -1,17 +1,16 @@
 package api
 
 import (
-	"context"
 	"errors"
+	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/getaddrinfo/proxy-fingerprint-scraper/common"
 	"github.com/getaddrinfo/proxy-fingerprint-scraper/database"
-	"go.uber.org/zap"
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/metrics"
 )
 
-var defaultCredsInsecure = "default_credentails_insecure"
-
 func (s *Server) AuthMiddleware(next http.Handler, permission common.Permission) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		token := r.URL.Query().Get("token")
@@ -20,36 +19,70 @@ func (s *Server) AuthMiddleware(next http.Handler, permission common.Permission)
 			token = r.Header.Get("Authorization")
 		}
 
-		if token == "" {
-			WriteError(w, "Unauthorized", nil, http.StatusUnauthorized)
+		var data database.GetAuthResult
+		var err error
+
+		// a token always wins over a client certificate, so a user with a mapped
+		// certificate can still act as someone else
+		if token != "" {
+			data, err = s.db.CheckAuthValid(r.Context(), token)
+		} else if subject, ok := clientCertSubject(r); ok {
+			data, err = s.db.CheckCertAuth(r.Context(), subject)
+		} else {
+			metrics.AuthFailures.WithLabelValues(metrics.AuthMissing).Inc()
+			WriteError(w, r, ErrUnauthorized, nil)
 			return
 		}
 
-		data, err := s.db.CheckAuthValid(token)
-
 		if err != nil && errors.Is(err, database.ErrDefaultToken) {
-			WriteError(w, "Security: Change the default admin token (you must do this through the database) - new token must be 32 characters", &defaultCredsInsecure, http.StatusForbidden)
+			metrics.AuthFailures.WithLabelValues(metrics.AuthDefaultToken).Inc()
+			WriteError(w, r, ErrDefaultCredentials, nil)
+			return
+		}
+
+		if err != nil && errors.Is(err, database.ErrTokenExpired) {
+			metrics.AuthFailures.WithLabelValues(metrics.AuthExpired).Inc()
+			WriteError(w, r, ErrTokenExpired, nil)
 			return
 		}
 
 		if err != nil {
-			zap.L().Error("error checking auth", zap.Error(err))
-			WriteError(w, "Internal Server Error", nil, http.StatusInternalServerError)
+			WriteError(w, r, ErrInternal, fmt.Errorf("checking auth: %w", err))
 			return
 		}
 
 		if !data.Valid {
-			WriteError(w, "Unauthorized", nil, http.StatusUnauthorized)
+			metrics.AuthFailures.WithLabelValues(metrics.AuthInvalid).Inc()
+			WriteError(w, r, ErrUnauthorized, nil)
 			return
 		}
 
 		if permission != 0 && !data.Permissions.Has(permission) {
-			WriteError(w, "Forbidden", nil, http.StatusForbidden)
+			metrics.AuthFailures.WithLabelValues(metrics.AuthForbidden).Inc()
+			WriteError(w, r, ErrForbidden, nil)
 			return
 		}
 
-		ctx := context.WithValue(r.Context(), "user", data)
+		s.db.MarkUsed(data.UserId)
+
+		ctx := withPrincipal(r.Context(), Principal{
+			UserId:      data.UserId,
+			Permissions: data.Permissions,
+		})
 
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+// DeprecatedMiddleware marks responses from a route that has moved from under
+// oldPrefix to under newPrefix, linking to where it lives now
+func (s *Server) DeprecatedMiddleware(next http.Handler, oldPrefix string, newPrefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		successor := newPrefix + strings.TrimPrefix(r.URL.Path, oldPrefix)
+
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,21 @@
+package api
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// APIPrefix is where the current version of the json api is mounted
+const APIPrefix = "/api/v1"
+
+// the OpenAPI document for everything under APIPrefix, every route registered
+// there must be described in it (see openapi_test.go)
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+func (s *Server) HandleGetOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(openAPIDocument)
+}
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+type openAPISpec struct {
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas map[string]json.RawMessage `json:"schemas"`
+	} `json:"components"`
+}
+
+// matches the pattern part of a gorilla route variable, {id:[0-9]+} -> {id}
+var routeVariablePattern = regexp.MustCompile(`\{([^}:]+):[^}]+\}`)
+
+func loadOpenAPISpec(t *testing.T) openAPISpec {
+	t.Helper()
+
+	var spec openAPISpec
+
+	if err := json.Unmarshal(openAPIDocument, &spec); err != nil {
+		t.Fatalf("openapi.json is not valid json: %s", err)
+	}
+
+	return spec
+}
+
+func TestOpenAPIDescribesEveryRoute(t *testing.T) {
+	spec := loadOpenAPISpec(t)
+
+	s := NewServer(NewServerOptions{})
+	s.InitRoutes()
+
+	checked := 0
+
+	err := s.router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+
+		if err != nil || !strings.HasPrefix(tmpl, APIPrefix+"/") {
+			return nil
+		}
+
+		path := routeVariablePattern.ReplaceAllString(strings.TrimPrefix(tmpl, APIPrefix), "{$1}")
+		methods, err := route.GetMethods()
+
+		if err != nil {
+			t.Errorf("%s: versioned routes must be registered with a method", tmpl)
+			return nil
+		}
+
+		operations, ok := spec.Paths[path]
+
+		if !ok {
+			t.Errorf("%s: missing from openapi.json (expected path %q)", tmpl, path)
+			return nil
+		}
+
+		for _, method := range methods {
+			if _, ok := operations[strings.ToLower(method)]; !ok {
+				t.Errorf("%s %s: missing from openapi.json", method, tmpl)
+			}
+		}
+
+		checked++
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if checked == 0 {
+		t.Fatalf("no routes found under %s", APIPrefix)
+	}
+}
+
+func TestOpenAPIDescribesResponseTypes(t *testing.T) {
+	spec := loadOpenAPISpec(t)
+
+	for _, name := range []string{"GetFingerprintResponse", "ListFingerprintsResponse", "StatsResponse", "ErrorResponse"} {
+		if _, ok := spec.Components.Schemas[name]; !ok {
+			t.Errorf("schema %s is missing from openapi.json", name)
+		}
+	}
+}
+
+func TestOpenAPIListsEveryErrorCode(t *testing.T) {
+	spec := loadOpenAPISpec(t)
+
+	var schema struct {
+		Properties struct {
+			Code struct {
+				Enum []string `json:"enum"`
+			} `json:"code"`
+		} `json:"properties"`
+	}
+
+	if err := json.Unmarshal(spec.Components.Schemas["ErrorResponse"], &schema); err != nil {
+		t.Fatal(err)
+	}
+
+	listed := map[string]bool{}
+
+	for _, code := range schema.Properties.Code.Enum {
+		listed[code] = true
+	}
+
+	for _, e := range ErrorCatalog {
+		if !listed[e.Code] {
+			t.Errorf("error code %s is missing from the ErrorResponse code enum", e.Code)
+		}
+	}
+}
+
+func TestUnknownRouteIsJSONError(t *testing.T) {
+	s := NewServer(NewServerOptions{})
+	s.InitRoutes()
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, APIPrefix+"/nope", nil))
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+
+	var body ErrorResponse
+
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body is not an ErrorResponse: %s", err)
+	}
+
+	if body.Code != ErrNotFound.Code || body.RequestID == "" || body.RequestID != w.Header().Get("X-Request-Id") {
+		t.Errorf("unexpected error body %+v", body)
+	}
+}
+
+func TestOpenAPIIsServed(t *testing.T) {
+	s := NewServer(NewServerOptions{})
+	s.InitRoutes()
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, APIPrefix+"/openapi.json", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected application/json, got %q", ct)
+	}
+}
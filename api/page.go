@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"html/template"
 	"strings"
+	"time"
 
 	"github.com/getaddrinfo/proxy-fingerprint-scraper/common"
 	"github.com/getaddrinfo/proxy-fingerprint-scraper/database"
@@ -14,48 +15,111 @@ import (
 type RenderHomeTemplateParams struct {
 	Count uint64
 
-	CanUseApi bool
-	Admin     bool
+	CanUseApi     bool
+	CanExport     bool
+	CanReadRecord bool
+	CanManage     bool
+	Admin         bool
 
 	RenderProxies bool
 	Proxies       []string
 }
 
 type RenderUserData struct {
-	Id         uint64
-	PermString string
+	Id          uint64
+	PermString  string
+	TokenPrefix string
+	Label       string
+	CreatedAt   string
+	ExpiresAt   string
+	LastUsedAt  string
 }
 
 type RenderAdminTemplateParams struct {
 	Users []RenderUserData
 }
 
-func RenderHomeTemplate(count uint64, user database.GetAuthResult, manager proxy.Manager) (string, error) {
+func RenderHomeTemplate(count uint64, user Principal, manager proxy.Manager) (string, error) {
 	str := `fingerprint generation service
 count: {{.Count}}
 
 auth:
 Your token can be provided either via the token query parameter, or via the Authorization header. Either is accepted.
+If the server accepts client certificates, a certificate mapped to your user can be used instead of a token.
 
 routes:
 GET /
 Shows this page
 
+GET /console
+A browser console for the service, log in with your token
+
 {{- if .Admin }}
 
 GET /admin
 Shows all the users registered with this app, and their permissions
+
+GET /admin/audit
+Lists admin actions and bulk exports, newest first (json, query: since, until, user_id, limit)
+
+GET /admin/retention
+Reports what the retention policy would delete now, without deleting anything (json, query: max_age, max_rows to preview another policy)
+{{- end}}
+
+{{- if .CanManage }}
+
+GET /admin/users
+Lists all the users registered with this app (json)
+
+POST /admin/users
+Creates a user with the given permissions, which the caller must hold, and returns its token
+(json, body: {"permission_names": [<string>], "label": <string>, "expires_at": <rfc3339, optional>, "cert_subject": <string, optional>})
+permissions: VIEW_HOME_PAGE, USE_API, ADMIN, VIEW_PROXIES, MANAGE_USERS, EXPORT, READ_RECORD
+
+POST /admin/users/{user.id}/rotate
+Replaces the token of a user whose permissions the caller holds, returning the new one (json)
+
+DELETE /admin/users/{user.id}
+Revokes the token of a user whose permissions the caller holds
+{{- end}}
+
+GET /healthz
+Reports that the process is running (json, no token needed)
+
+GET /readyz
+Reports whether the database is reachable and migrated, and the server is not draining before exit (json, no token needed)
+
+GET /metrics
+Service metrics in the prometheus text format (needs the metrics token as a bearer token, if one is configured)
+
+GET /api/v1/openapi.json
+The OpenAPI document describing the api (the unversioned /api/... routes are deprecated aliases)
+
+{{- if .CanExport }}
+
+GET /api/v1/fingerprints/export
+Streams all the fingerprints in the database (query: format=ndjson|csv|text, or use the Accept header)
+
+GET /api/v1/fingerprints/raw
+Lists all the fingerprints in the database, one per line
 {{- end}}
 
 {{- if .CanUseApi }}
 
-GET /api/fingerprints{/raw}
-Lists all the fingerprints in the database
+GET /api/v1/fingerprints
+Lists the fingerprints in the database, newest first (json, query: limit, cursor, since_id, proxy_ip)
+Pass next_cursor from a response as cursor to fetch the next page
 
-GET /api/fingerprints/random
+GET /api/v1/fingerprints/random
 Returns a random fingerprint from the database (json) 
 
-GET /api/fingerprints/{fingerprint.id}
+GET /api/v1/stats
+Returns the fingerprint count, inserts per period and service statistics (json, query: window, period=hour|day)
+{{- end}}
+
+{{- if .CanReadRecord }}
+
+GET /api/v1/fingerprints/{fingerprint.id}
 Returns a specific fingerprint from the database (json)
 {{- end}}
 
@@ -72,9 +136,9 @@ proxies:
 	isAdmin := user.Permissions.Has(common.PermissionAdmin)
 
 	var proxies []string
-	renderProxies := manager != nil
+	renderProxies := manager != nil && user.Permissions.Has(common.PermissionViewProxies)
 
-	if manager != nil {
+	if renderProxies {
 		proxies = manager.IPs()
 	}
 
@@ -83,6 +147,9 @@ proxies:
 		Proxies:       proxies,
 		RenderProxies: renderProxies,
 		CanUseApi:     canUseApi,
+		CanExport:     user.Permissions.Has(common.PermissionExport),
+		CanReadRecord: user.Permissions.Has(common.PermissionReadRecord),
+		CanManage:     user.Permissions.Has(common.PermissionManageUsers),
 		Admin:         isAdmin,
 	}
 
@@ -95,16 +162,16 @@ proxies:
 	return out.String(), nil
 }
 
-func RenderAdminTemplate(users []database.GetUserResult) (string, error) {
-	str := `fingerprint generation service
+func formatOptionalTime(t *time.Time, fallback string) string {
+	if t == nil {
+		return fallback
+	}
 
-users:
-{{ range .Users -}}
-id={{ .Id }} permissions={{.PermString}}
-{{ end }}
-`
-	tmpl := template.Must(template.New("index").Parse(str))
-	var renderUsers []RenderUserData
+	return t.Format(time.RFC3339)
+}
+
+func NewRenderUserData(users []database.GetUserResult) []RenderUserData {
+	var out []RenderUserData
 
 	for _, user := range users {
 		var permString = strings.Join(user.Permissions.List(), ", ")
@@ -115,14 +182,33 @@ id={{ .Id }} permissions={{.PermString}}
 			permString = fmt.Sprintf("(%s)", permString)
 		}
 
-		renderUsers = append(renderUsers, RenderUserData{
-			Id:         user.UserId,
-			PermString: permString,
+		out = append(out, RenderUserData{
+			Id:          user.UserId,
+			PermString:  permString,
+			TokenPrefix: user.TokenPrefix,
+			Label:       user.Label,
+			CreatedAt:   user.CreatedAt.Format(time.RFC3339),
+			ExpiresAt:   formatOptionalTime(user.ExpiresAt, "never"),
+			LastUsedAt:  formatOptionalTime(user.LastUsedAt, "never"),
 		})
 	}
 
+	return out
+}
+
+func RenderAdminTemplate(users []database.GetUserResult) (string, error) {
+	str := `fingerprint generation service
+
+users:
+{{ range .Users -}}
+id={{ .Id }} token={{ .TokenPrefix }}... permissions={{.PermString}} label={{ .Label }}
+    created={{ .CreatedAt }} expires={{ .ExpiresAt }} last_used={{ .LastUsedAt }}
+{{ end }}
+`
+	tmpl := template.Must(template.New("index").Parse(str))
+
 	data := RenderAdminTemplateParams{
-		Users: renderUsers,
+		Users: NewRenderUserData(users),
 	}
 
 	var out bytes.Buffer
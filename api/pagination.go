@@ -0,0 +1,45 @@
+package api
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const defaultPageLimit = 100
+const maxPageLimit = 1000
+
+// cursors are opaque to clients so that what they encode can change later
+const cursorPrefix = "id:"
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// fingerprint ids are a SERIAL column, larger values cannot be sent to postgres
+const fingerprintIDBits = 31
+
+// parseFingerprintID parses an id given by a client, rejecting any that could
+// not belong to a fingerprint
+func parseFingerprintID(value string) (uint64, error) {
+	return strconv.ParseUint(value, 10, fingerprintIDBits)
+}
+
+func encodeCursor(id uint64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(cursorPrefix + strconv.FormatUint(id, 10)))
+}
+
+func decodeCursor(cursor string) (uint64, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+
+	if err != nil || !strings.HasPrefix(string(data), cursorPrefix) {
+		return 0, errInvalidCursor
+	}
+
+	id, err := parseFingerprintID(strings.TrimPrefix(string(data), cursorPrefix))
+
+	if err != nil {
+		return 0, errInvalidCursor
+	}
+
+	return id, nil
+}
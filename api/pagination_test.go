@@ -0,0 +1,44 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/common"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	for _, id := range []uint64{0, 1, 42, 1<<31 - 1} {
+		got, err := decodeCursor(encodeCursor(id))
+
+		if err != nil {
+			t.Fatalf("decoding cursor for %d: %s", id, err)
+		}
+
+		if got != id {
+			t.Errorf("expected %d, got %d", id, got)
+		}
+	}
+}
+
+func TestDecodeInvalidCursor(t *testing.T) {
+	for _, cursor := range []string{"", "not base64!", "MTIz", encodeCursor(1) + "A", encodeCursor(1 << 31)} {
+		if _, err := decodeCursor(cursor); err == nil {
+			t.Errorf("expected %q to be rejected", cursor)
+		}
+	}
+}
+
+// ids past the range of the SERIAL column are the client's mistake, not ours
+func TestFingerprintIDOutOfRange(t *testing.T) {
+	env := newTestEnv(t, NewServerOptions{})
+	_, token := env.user(common.PermissionUseAPI | common.PermissionReadRecord)
+
+	for _, path := range []string{
+		APIPrefix + "/fingerprints?since_id=3000000000",
+		APIPrefix + "/fingerprints?cursor=" + encodeCursor(3000000000),
+		APIPrefix + "/fingerprints/3000000000",
+	} {
+		expectError(t, env.do(http.MethodGet, path, token, ""), ErrBadRequest)
+	}
+}
@@ -0,0 +1,27 @@
+package api
+
+import (
+	"context"
+
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/common"
+)
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	UserId      uint64
+	Permissions common.Permission
+}
+
+// unexported so that nothing outside of this package can set or overwrite the principal
+type principalKey struct{}
+
+func withPrincipal(ctx context.Context, principal Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext returns the caller stored by AuthMiddleware, ok is false
+// if the request did not pass through it
+func PrincipalFromContext(ctx context.Context) (Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(Principal)
+	return principal, ok
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type RateLimitConfig struct {
+	// maximum requests per Window, 0 disables the limit
+	Requests uint64
+	Window   time.Duration
+
+	// maximum requests per day (UTC), 0 disables the quota
+	DailyQuota uint64
+}
+
+func (c RateLimitConfig) Enabled() bool {
+	return (c.Requests > 0 && c.Window > 0) || c.DailyQuota > 0
+}
+
+func retryAfter(until time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(until.Seconds())))
+}
+
+// RateLimitMiddleware enforces the configured limits per user, so it must be
+// wrapped by AuthMiddleware
+func (s *Server) RateLimitMiddleware(next http.Handler) http.Handler {
+	if !s.rateLimit.Enabled() {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := PrincipalFromContext(r.Context())
+
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		now := time.Now().UTC()
+		window := s.rateLimit.Window
+
+		if window <= 0 {
+			window = time.Minute
+		}
+
+		windowStart := now.Truncate(window)
+		dayStart := now.Truncate(time.Hour * 24)
+
+		counts, err := s.db.HitRateLimit(r.Context(), user.UserId, windowStart, dayStart)
+
+		if err != nil {
+			WriteError(w, r, ErrInternal, fmt.Errorf("updating rate limit: %w", err))
+			return
+		}
+
+		if s.rateLimit.DailyQuota > 0 && counts.Day > s.rateLimit.DailyQuota {
+			w.Header().Set("Retry-After", retryAfter(dayStart.Add(time.Hour*24).Sub(now)))
+			WriteError(w, r, ErrRateLimited.WithMessage("daily quota exceeded"), nil)
+			return
+		}
+
+		if s.rateLimit.Requests > 0 && counts.Window > s.rateLimit.Requests {
+			w.Header().Set("Retry-After", retryAfter(windowStart.Add(window).Sub(now)))
+			WriteError(w, r, ErrRateLimited, nil)
+			return
+		}
+
+		if s.rateLimit.Requests > 0 {
+			w.Header().Set("X-RateLimit-Limit", strconv.FormatUint(s.rateLimit.Requests, 10))
+			w.Header().Set("X-RateLimit-Remaining", strconv.FormatUint(s.rateLimit.Requests-counts.Window, 10))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,45 @@
+package api
+
+import (
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// RecoveryMiddleware turns a panicking handler into a 500 response instead of
+// a dropped connection
+func (s *Server) RecoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := newStatusRecorder(w)
+
+		defer func() {
+			err := recover()
+
+			if err == nil {
+				return
+			}
+
+			// used by net/http to abort a response on purpose
+			if err == http.ErrAbortHandler {
+				panic(err)
+			}
+
+			LoggerFromContext(r.Context()).Named("recover").Error(
+				"handler panicked",
+				zap.String("method", r.Method),
+				zap.String("path", r.URL.Path),
+				zap.Any("panic", err),
+				zap.StackSkip("stack", 2),
+			)
+
+			// nothing can be done about a response that has already started
+			if recorder.wroteHeader {
+				return
+			}
+
+			writeError(recorder, ErrInternal)
+		}()
+
+		next.ServeHTTP(recorder, r)
+	})
+}
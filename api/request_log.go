@@ -0,0 +1,100 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/common"
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/metrics"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// ids from clients and proxies are only honoured if they are reasonable to log
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// unexported for the same reason as principalKey
+type loggerKey struct{}
+
+func withLogger(ctx context.Context, logger *zap.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// LoggerFromContext returns the logger for the request, which carries its id.
+// Requests that did not pass through RequestLogMiddleware get the api logger.
+func LoggerFromContext(ctx context.Context) *zap.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*zap.Logger); ok {
+		return logger
+	}
+
+	return zap.L().Named("api")
+}
+
+// requestID returns the id of the request, which is also sent as the
+// X-Request-Id header, assigning one if nothing has yet
+func requestID(w http.ResponseWriter) string {
+	id := w.Header().Get("X-Request-Id")
+
+	if id == "" {
+		id = common.GenerateID("req")
+		w.Header().Set("X-Request-Id", id)
+	}
+
+	return id
+}
+
+// RequestLogMiddleware gives every request an id, honouring one sent in the
+// X-Request-Id header, and logs and counts each once it has been served
+func (s *Server) RequestLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := r.Header.Get("X-Request-Id"); validRequestID.MatchString(id) {
+			w.Header().Set("X-Request-Id", id)
+		}
+
+		logger := zap.L().Named("api").With(zap.String("request", requestID(w)))
+
+		recorder := newStatusRecorder(w)
+		start := time.Now()
+
+		next.ServeHTTP(recorder, r.WithContext(withLogger(r.Context(), logger)))
+
+		duration := time.Since(start)
+		route := s.routeTemplate(r)
+		method := metrics.HTTPMethod(r.Method)
+
+		metrics.HTTPRequests.WithLabelValues(route, method, strconv.Itoa(recorder.status)).Inc()
+		metrics.HTTPDuration.WithLabelValues(route, method).Observe(duration.Seconds())
+
+		logger.Info(
+			"request",
+			zap.String("method", r.Method),
+			zap.String("route", route),
+			zap.String("path", r.URL.Path),
+			zap.Int("status", recorder.status),
+			zap.Int("bytes", recorder.bytes),
+			zap.Duration("duration", duration),
+			zap.String("remote", r.RemoteAddr),
+		)
+	})
+}
+
+// routeTemplate returns the template of the route the request matches, so
+// requests for different ids are logged under the same route
+func (s *Server) routeTemplate(r *http.Request) string {
+	var match mux.RouteMatch
+
+	if !s.router.Match(r, &match) || match.Route == nil {
+		return "unmatched"
+	}
+
+	tmpl, err := match.Route.GetPathTemplate()
+
+	if err != nil {
+		return "unmatched"
+	}
+
+	return tmpl
+}
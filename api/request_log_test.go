@@ -0,0 +1,57 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRequestLogHonoursRequestID(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	defer zap.ReplaceGlobals(zap.New(core))()
+
+	s := NewServer(NewServerOptions{})
+	s.InitRoutes()
+
+	r := httptest.NewRequest(http.MethodGet, APIPrefix+"/openapi.json", nil)
+	r.Header.Set("X-Request-Id", "edge-1234")
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+
+	if id := w.Header().Get("X-Request-Id"); id != "edge-1234" {
+		t.Fatalf("expected the incoming id to be kept, got %q", id)
+	}
+
+	entries := logs.FilterMessage("request").All()
+
+	if len(entries) != 1 {
+		t.Fatalf("expected one access log line, got %d", len(entries))
+	}
+
+	fields := entries[0].ContextMap()
+
+	if fields["request"] != "edge-1234" || fields["route"] != APIPrefix+"/openapi.json" || fields["status"] != int64(http.StatusOK) {
+		t.Errorf("unexpected access log fields %v", fields)
+	}
+}
+
+func TestRequestLogReplacesInvalidRequestID(t *testing.T) {
+	s := NewServer(NewServerOptions{})
+	s.InitRoutes()
+
+	r := httptest.NewRequest(http.MethodGet, APIPrefix+"/openapi.json", nil)
+	r.Header.Set("X-Request-Id", "has spaces\nand newlines")
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, r)
+
+	if id := w.Header().Get("X-Request-Id"); !strings.HasPrefix(id, "req_") {
+		t.Fatalf("expected a generated id, got %q", id)
+	}
+}
@@ -0,0 +1,19 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+func WriteJSON(w http.ResponseWriter, r *http.Request, v interface{}, status int) {
+	data, err := json.Marshal(v)
+
+	if err != nil {
+		WriteError(w, r, ErrInternal, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// HandleGetRetention reports what the retention job would delete if it ran
+// now, without deleting anything. max_age and max_rows preview a different
+// policy from the one configured.
+func (s *Server) HandleGetRetention(w http.ResponseWriter, r *http.Request) {
+	policy := s.retention
+	query := r.URL.Query()
+
+	if value := query.Get("max_age"); value != "" {
+		maxAge, err := time.ParseDuration(value)
+
+		if err != nil || maxAge < 0 {
+			WriteError(w, r, ErrBadRequest.WithMessage("max_age must be a duration such as 720h, or 0 for no limit"), nil)
+			return
+		}
+
+		policy.MaxAge = maxAge
+	}
+
+	if value := query.Get("max_rows"); value != "" {
+		// 63 bits, postgres has no unsigned integers to bind it to
+		maxRows, err := strconv.ParseUint(value, 10, 63)
+
+		if err != nil {
+			WriteError(w, r, ErrBadRequest.WithMessage("max_rows must be an integer in 0..9223372036854775807"), nil)
+			return
+		}
+
+		policy.MaxRows = maxRows
+	}
+
+	report, err := s.db.CheckRetention(r.Context(), policy)
+
+	if err != nil {
+		WriteError(w, r, ErrInternal, err)
+		return
+	}
+
+	WriteJSON(w, r, RetentionResponse{
+		Enabled:       policy.Enabled(),
+		MaxAgeSeconds: uint64(policy.MaxAge.Seconds()),
+		MaxRows:       policy.MaxRows,
+		WouldDelete:   report.Count,
+		MaxID:         report.MaxID,
+		Oldest:        report.Oldest,
+		Newest:        report.Newest,
+	}, http.StatusOK)
+}
@@ -1,146 +1,161 @@
 package api
 
 import (
-	"encoding/json"
 	"errors"
-	"fmt"
 	"net/http"
 	"strconv"
 
 	"github.com/getaddrinfo/proxy-fingerprint-scraper/database"
 	"github.com/gorilla/mux"
-	"github.com/jackc/pgx/v4"
-	"go.uber.org/zap"
 )
 
-var codeNoFingerprints = "no_fingerprints"
+// handlers that read the principal fail with this if they were mounted without AuthMiddleware
+var errMissingPrincipal = errors.New("route is missing AuthMiddleware")
 
 func (s *Server) HandleGetRandomFingerprint(w http.ResponseWriter, r *http.Request) {
-	fp, err := s.db.GetRandomFingerprint()
-	w.Header().Set("Content-Type", "application/json")
+	fp, err := s.db.GetRandomFingerprint(r.Context())
 
-	if err != nil && errors.Is(err, pgx.ErrNoRows) {
-		WriteError(w, "No Fingerprints", &codeNoFingerprints, http.StatusNotFound)
+	if err != nil && errors.Is(err, database.ErrFingerprintNotFound) {
+		WriteError(w, r, ErrNoFingerprints, nil)
 		return
 	}
 
 	if err != nil {
-		WriteError(w, "Internal Server Error", nil, http.StatusInternalServerError)
+		WriteError(w, r, ErrInternal, err)
 		return
 	}
 
-	data, err := json.Marshal(GetFingerprintResponse{
+	WriteJSON(w, r, GetFingerprintResponse{
 		ID:          fp.ID,
 		Fingerprint: fp.Fingerprint,
 		ProxyIP:     fp.ProxyIP,
-	})
-
-	if err != nil {
-		WriteError(w, "Internal Server Error", nil, http.StatusInternalServerError)
-		return
-	}
-
-	w.WriteHeader(http.StatusOK)
-	w.Write(data)
+		CreatedAt:   fp.CreatedAt,
+	}, http.StatusOK)
 }
 
 func (s *Server) HandleGetSpecificFingerprint(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 
-	value, err := strconv.ParseUint(vars["id"], 10, 64)
+	value, err := parseFingerprintID(vars["id"])
 
 	if err != nil {
-		WriteError(w, "Bad Request: id is not a valid uint64", nil, http.StatusBadRequest)
+		WriteError(w, r, ErrBadRequest.WithMessage("id is not a valid fingerprint id"), nil)
 		return
 	}
 
-	fp, err := s.db.GetSpecificFingerprint(value)
-	w.Header().Set("Content-Type", "application/json")
+	fp, err := s.db.GetSpecificFingerprint(r.Context(), value)
 
-	if err != nil && errors.Is(err, pgx.ErrNoRows) {
-		WriteError(w, "Not Found", nil, http.StatusNotFound)
+	if err != nil && errors.Is(err, database.ErrFingerprintNotFound) {
+		WriteError(w, r, ErrNotFound, nil)
 		return
 	}
 
 	if err != nil {
-		WriteError(w, "Internal Server Error", nil, http.StatusInternalServerError)
+		WriteError(w, r, ErrInternal, err)
 		return
 	}
 
-	data, err := json.Marshal(GetFingerprintResponse{
+	WriteJSON(w, r, GetFingerprintResponse{
 		ID:          fp.ID,
 		Fingerprint: fp.Fingerprint,
 		ProxyIP:     fp.ProxyIP,
-	})
-
-	if err != nil {
-		WriteError(w, "Internal Server Error", nil, http.StatusInternalServerError)
-		return
-	}
-
-	w.WriteHeader(http.StatusOK)
-	w.Write(data)
+		CreatedAt:   fp.CreatedAt,
+	}, http.StatusOK)
 }
 
 func (s *Server) HandleGetAllFingerprintsJson(w http.ResponseWriter, r *http.Request) {
-	fps, err := s.db.GetAllFingerprints()
-	w.Header().Set("Content-Type", "application/json")
+	query := r.URL.Query()
+	options := database.ListFingerprintsOptions{Limit: defaultPageLimit}
 
-	if err != nil {
-		zap.S().Named("api.get_all_fingerprints").Error(err.Error())
-		WriteError(w, "Internal Server Error", nil, http.StatusInternalServerError)
-		return
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.ParseUint(value, 10, 64)
+
+		if err != nil || limit == 0 || limit > maxPageLimit {
+			WriteError(w, r, ErrBadRequest.WithMessage("limit must be in 1..1000"), nil)
+			return
+		}
+
+		options.Limit = limit
 	}
 
-	if fps == nil {
-		fps = []string{}
+	if value := query.Get("cursor"); value != "" {
+		before, err := decodeCursor(value)
+
+		if err != nil {
+			WriteError(w, r, ErrBadRequest.WithMessage("cursor is not valid"), nil)
+			return
+		}
+
+		options.BeforeID = &before
 	}
 
-	data, err := json.Marshal(fps)
+	if value := query.Get("since_id"); value != "" {
+		since, err := parseFingerprintID(value)
 
-	if err != nil {
-		WriteError(w, "Internal Server Error", nil, http.StatusInternalServerError)
-		return
+		if err != nil {
+			WriteError(w, r, ErrBadRequest.WithMessage("since_id is not a valid fingerprint id"), nil)
+			return
+		}
+
+		options.SinceID = &since
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(data))
-}
+	if value := query.Get("proxy_ip"); value != "" {
+		options.ProxyIP = &value
+	}
 
-func (s *Server) HandleGetAllFingerprintsRaw(w http.ResponseWriter, r *http.Request) {
-	fps, err := s.db.GetAllFingerprints()
+	// one extra row tells us whether there is another page without a count
+	limit := options.Limit
+	options.Limit++
+
+	fps, err := s.db.ListFingerprints(r.Context(), options)
 
 	if err != nil {
-		zap.S().Named("api.get_all_fingerprints").Error(err.Error())
-		WriteError(w, "Internal Server Error", nil, http.StatusInternalServerError)
+		WriteError(w, r, ErrInternal, err)
 		return
 	}
 
-	out := ""
+	out := ListFingerprintsResponse{
+		Items: []GetFingerprintResponse{},
+	}
+
+	if uint64(len(fps)) > limit {
+		fps = fps[:limit]
+		cursor := encodeCursor(fps[len(fps)-1].ID)
+		out.NextCursor = &cursor
+	}
 
 	for _, fp := range fps {
-		out += fmt.Sprintf("%s\n", fp)
+		out.Items = append(out.Items, GetFingerprintResponse{
+			ID:          fp.ID,
+			Fingerprint: fp.Fingerprint,
+			ProxyIP:     fp.ProxyIP,
+			CreatedAt:   fp.CreatedAt,
+		})
 	}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(out))
+	WriteJSON(w, r, out, http.StatusOK)
 }
 
 func (s *Server) HandleGetMeta(w http.ResponseWriter, r *http.Request) {
-	result, err := s.db.CountFingerprints()
+	result, err := s.db.CountFingerprints(r.Context())
 
 	if err != nil {
-		WriteError(w, "Internal Server Error", nil, http.StatusInternalServerError)
+		WriteError(w, r, ErrInternal, err)
 		return
 	}
 
-	user := r.Context().Value("user").(database.GetAuthResult)
+	user, ok := PrincipalFromContext(r.Context())
+
+	if !ok {
+		WriteError(w, r, ErrInternal, errMissingPrincipal)
+		return
+	}
 
 	txt, err := RenderHomeTemplate(result, user, s.pm)
 
 	if err != nil {
-		zap.L().Named("api.home").Error(err.Error())
-		WriteError(w, "Internal Server Error", nil, http.StatusInternalServerError)
+		WriteError(w, r, ErrInternal, err)
 		return
 	}
 
@@ -148,18 +163,17 @@ func (s *Server) HandleGetMeta(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) HandleAdmin(w http.ResponseWriter, r *http.Request) {
-	result, err := s.db.GetAllUsers()
+	result, err := s.db.GetAllUsers(r.Context())
 
 	if err != nil {
-		WriteError(w, "Internal Server Error", nil, http.StatusInternalServerError)
+		WriteError(w, r, ErrInternal, err)
 		return
 	}
 
 	txt, err := RenderAdminTemplate(result)
 
 	if err != nil {
-		zap.L().Named("api.home").Error(err.Error())
-		WriteError(w, "Internal Server Error", nil, http.StatusInternalServerError)
+		WriteError(w, r, ErrInternal, err)
 		return
 	}
 
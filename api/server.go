@@ -1,8 +1,12 @@
 package api
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"sync/atomic"
+	"time"
 
 	"github.com/getaddrinfo/proxy-fingerprint-scraper/common"
 	"github.com/getaddrinfo/proxy-fingerprint-scraper/database"
@@ -12,38 +16,227 @@ import (
 )
 
 type Server struct {
-	router *mux.Router
-	db     *database.Database
-	pm     proxy.Manager
-	port   int
+	router    *mux.Router
+	http      *http.Server
+	db        database.Store
+	pm        proxy.Manager
+	port      int
+	listener  ListenerOptions
+	rateLimit RateLimitConfig
+	retention database.RetentionPolicy
+
+	metricsToken   string
+	metricsHandler http.Handler
+
+	// marks console cookies Secure even on plain http connections
+	secureCookies bool
+
+	// set once Shutdown is called, failing readiness checks
+	shuttingDown atomic.Bool
+	drainDelay   time.Duration
+}
+
+type NewServerOptions struct {
+	Store        database.Store
+	ProxyManager proxy.Manager
+	Port         int
+	Listener     ListenerOptions
+	RateLimit    RateLimitConfig
+	Timeouts     Timeouts
+	// required as a bearer token by /metrics, empty leaves it open
+	MetricsToken string
+	// the policy enforced by the retention job, previewed by /admin/retention
+	Retention database.RetentionPolicy
+	// how long Shutdown keeps serving with /readyz failing before it closes
+	// the listener, so that load balancers stop sending requests first
+	DrainDelay time.Duration
+	// marks console cookies Secure on every connection, for serving plain http
+	// behind a proxy that terminates TLS
+	SecureCookies bool
+}
+
+// Timeouts bounds how long a single connection may take, any left at zero use
+// the defaults below
+type Timeouts struct {
+	// reading the whole request, including the body
+	Read time.Duration
+	// from the end of reading the request to the end of writing the response,
+	// exports of large databases must finish within it
+	Write time.Duration
+	// between requests on a keep-alive connection
+	Idle time.Duration
 }
 
-func NewServer(db *database.Database, pm proxy.Manager, port int) *Server {
-	return &Server{
-		router: mux.NewRouter(),
-		db:     db,
-		pm:     pm,
-		port:   port,
+const (
+	DefaultReadTimeout  = time.Second * 15
+	DefaultWriteTimeout = time.Minute * 2
+	DefaultIdleTimeout  = time.Minute * 2
+)
+
+func orDefault(value time.Duration, fallback time.Duration) time.Duration {
+	if value == 0 {
+		return fallback
 	}
+
+	return value
 }
 
-func (s *Server) Run() {
-	zap.S().Info("server starting at http://localhost:", s.port)
-	err := http.ListenAndServe(fmt.Sprintf(":%d", s.port), s.router)
+func NewServer(options NewServerOptions) *Server {
+	s := &Server{
+		router:    mux.NewRouter(),
+		db:        options.Store,
+		pm:        options.ProxyManager,
+		port:      options.Port,
+		listener:  options.Listener,
+		rateLimit: options.RateLimit,
+		retention: options.Retention,
+
+		metricsToken: options.MetricsToken,
+		drainDelay:   options.DrainDelay,
+
+		secureCookies: options.SecureCookies,
+	}
+
+	s.metricsHandler = newMetricsHandler(options.Store)
+
+	s.http = &http.Server{
+		Addr:         fmt.Sprintf(":%d", options.Port),
+		Handler:      s.Handler(),
+		ReadTimeout:  orDefault(options.Timeouts.Read, DefaultReadTimeout),
+		WriteTimeout: orDefault(options.Timeouts.Write, DefaultWriteTimeout),
+		IdleTimeout:  orDefault(options.Timeouts.Idle, DefaultIdleTimeout),
+		ErrorLog:     zap.NewStdLog(zap.L().Named("api.http")),
+	}
+
+	return s
+}
+
+// Run serves until Shutdown is called, returning nil if that is why it stopped
+func (s *Server) Run() error {
+	listener, err := s.listen()
 
 	if err != nil {
 		zap.S().Named("api").Error(err.Error())
+		return err
 	}
+
+	zap.S().Info("server starting at ", s.address())
+	err = s.serve(listener)
+
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		zap.S().Named("api").Error(err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// Shutdown fails readiness checks for the drain delay, then stops accepting
+// connections and waits for in-flight requests to finish. If ctx is done first
+// the remaining connections are closed forcibly and the context's error is
+// returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shuttingDown.Store(true)
+
+	log := zap.L().Named("api")
+
+	if s.drainDelay > 0 {
+		log.Info("failing readiness checks before draining", zap.Duration("delay", s.drainDelay))
+
+		select {
+		case <-time.After(s.drainDelay):
+		case <-ctx.Done():
+		}
+	}
+
+	log.Info("shutting down, draining requests")
+
+	err := s.http.Shutdown(ctx)
+
+	if err != nil {
+		log.Warn("requests did not finish in time, closing them", zap.Error(err))
+		s.http.Close()
+		return err
+	}
+
+	log.Info("shut down")
+	return nil
+}
+
+// Handler returns the router wrapped in the middleware shared by every route
+func (s *Server) Handler() http.Handler {
+	return s.RequestLogMiddleware(s.RecoveryMiddleware(s.router))
 }
 
 func (s *Server) InitRoutes() {
+	// admin routes are always audited
+	admin := func(h http.HandlerFunc, permission common.Permission) http.Handler {
+		return s.AuthMiddleware(s.AuditMiddleware(h), permission)
+	}
+
+	// bulk exports are audited as well as rate limited
+	export := func(h http.HandlerFunc) http.Handler {
+		return s.AuthMiddleware(s.AuditMiddleware(s.RateLimitMiddleware(h)), common.PermissionExport)
+	}
+
 	// viewable pages
 	s.router.Handle("/", s.AuthMiddleware(http.HandlerFunc(s.HandleGetMeta), common.PermissionViewHomePage))
-	s.router.Handle("/admin", s.AuthMiddleware(http.HandlerFunc(s.HandleAdmin), common.PermissionAdmin))
+	s.router.Handle("/admin", admin(s.HandleAdmin, common.PermissionAdmin))
+
+	// admin
+	s.router.Handle("/admin/users", admin(s.HandleListUsers, common.PermissionManageUsers)).Methods(http.MethodGet)
+	s.router.Handle("/admin/users", admin(s.HandleCreateUser, common.PermissionManageUsers)).Methods(http.MethodPost)
+	s.router.Handle("/admin/users/{id:[0-9]+}/rotate", admin(s.HandleRotateToken, common.PermissionManageUsers)).Methods(http.MethodPost)
+	s.router.Handle("/admin/users/{id:[0-9]+}", admin(s.HandleRevokeUser, common.PermissionManageUsers)).Methods(http.MethodDelete)
+	s.router.Handle("/admin/audit", admin(s.HandleGetAuditLog, common.PermissionAdmin)).Methods(http.MethodGet)
+	s.router.Handle("/admin/retention", admin(s.HandleGetRetention, common.PermissionAdmin)).Methods(http.MethodGet)
+
+	// console
+	console := func(h http.HandlerFunc, permission common.Permission) http.Handler {
+		return s.SessionMiddleware(h, permission)
+	}
+
+	// changes made through the console are audited like the admin api
+	consoleAction := func(h http.HandlerFunc, permission common.Permission) http.Handler {
+		return s.SessionMiddleware(s.AuditMiddleware(h), permission)
+	}
+
+	s.router.Handle("/console/login", http.HandlerFunc(s.HandleConsoleLoginPage)).Methods(http.MethodGet)
+	s.router.Handle("/console/login", http.HandlerFunc(s.HandleConsoleLogin)).Methods(http.MethodPost)
+	s.router.Handle("/console/logout", console(s.HandleConsoleLogout, 0)).Methods(http.MethodPost)
+	s.router.Handle("/console", console(s.HandleConsoleStatus, common.PermissionViewHomePage)).Methods(http.MethodGet)
+	s.router.Handle("/console/users", console(s.HandleConsoleUsers, common.PermissionManageUsers)).Methods(http.MethodGet)
+	s.router.Handle("/console/users", consoleAction(s.HandleConsoleCreateUser, common.PermissionManageUsers)).Methods(http.MethodPost)
+	s.router.Handle("/console/users/{id:[0-9]+}/rotate", consoleAction(s.HandleConsoleRotateToken, common.PermissionManageUsers)).Methods(http.MethodPost)
+	s.router.Handle("/console/users/{id:[0-9]+}/revoke", consoleAction(s.HandleConsoleRevokeUser, common.PermissionManageUsers)).Methods(http.MethodPost)
+	s.router.Handle("/console/audit", console(s.HandleConsoleAudit, common.PermissionAdmin)).Methods(http.MethodGet)
 
 	// api
-	s.router.Handle("/api/fingerprints", s.AuthMiddleware(http.HandlerFunc(s.HandleGetAllFingerprintsJson), common.PermissionUseAPI))
-	s.router.Handle("/api/fingerprints/raw", s.AuthMiddleware(http.HandlerFunc(s.HandleGetAllFingerprintsRaw), common.PermissionUseAPI))
-	s.router.Handle("/api/fingerprints/random", s.AuthMiddleware(http.HandlerFunc(s.HandleGetRandomFingerprint), common.PermissionUseAPI))
-	s.router.Handle("/api/fingerprints/{id:[0-9]+}", s.AuthMiddleware(http.HandlerFunc(s.HandleGetSpecificFingerprint), common.PermissionAdmin))
+	s.handleAPI("/fingerprints", s.AuthMiddleware(s.RateLimitMiddleware(http.HandlerFunc(s.HandleGetAllFingerprintsJson)), common.PermissionUseAPI))
+	s.handleAPI("/fingerprints/raw", export(s.HandleGetAllFingerprintsRaw))
+	s.handleAPI("/fingerprints/random", s.AuthMiddleware(s.RateLimitMiddleware(http.HandlerFunc(s.HandleGetRandomFingerprint)), common.PermissionUseAPI))
+	s.handleAPI("/fingerprints/{id:[0-9]+}", s.AuthMiddleware(s.RateLimitMiddleware(http.HandlerFunc(s.HandleGetSpecificFingerprint)), common.PermissionReadRecord))
+
+	s.router.Handle(APIPrefix+"/fingerprints/export", export(s.HandleExportFingerprints)).Methods(http.MethodGet)
+	s.router.Handle(APIPrefix+"/stats", s.AuthMiddleware(s.RateLimitMiddleware(http.HandlerFunc(s.HandleGetStats)), common.PermissionUseAPI)).Methods(http.MethodGet)
+	s.router.Handle(APIPrefix+"/openapi.json", http.HandlerFunc(s.HandleGetOpenAPI)).Methods(http.MethodGet)
+
+	// probes for orchestrators and load balancers, so never authenticated
+	s.router.HandleFunc("/healthz", s.HandleHealthz).Methods(http.MethodGet)
+	s.router.HandleFunc("/readyz", s.HandleReadyz).Methods(http.MethodGet)
+	s.router.HandleFunc("/metrics", s.HandleMetrics).Methods(http.MethodGet)
+
+	s.router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteError(w, r, ErrNotFound, nil)
+	})
+	s.router.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteError(w, r, ErrMethodNotAllowed, nil)
+	})
+}
+
+// handleAPI mounts a GET route under APIPrefix, along with the unversioned
+// path it used to live at (which is deprecated)
+func (s *Server) handleAPI(path string, handler http.Handler) {
+	s.router.Handle(APIPrefix+path, handler).Methods(http.MethodGet)
+	s.router.Handle("/api"+path, s.DeprecatedMiddleware(handler, "/api", APIPrefix)).Methods(http.MethodGet)
 }
@@ -0,0 +1,730 @@
+package api
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/common"
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/database"
+)
+
+// testEnv is a server backed by a MemoryStore, so every route can be served
+// without postgres
+type testEnv struct {
+	t      *testing.T
+	server *Server
+	store  *database.MemoryStore
+}
+
+func newTestEnv(t *testing.T, options NewServerOptions) *testEnv {
+	t.Helper()
+
+	store := database.NewMemoryStore()
+	options.Store = store
+
+	s := NewServer(options)
+	s.InitRoutes()
+
+	return &testEnv{t: t, server: s, store: store}
+}
+
+// user creates a user with the given permissions, returning its id and token
+func (e *testEnv) user(permissions common.Permission) (uint64, string) {
+	e.t.Helper()
+
+	user, token, err := e.store.CreateUser(context.Background(), database.CreateUserOptions{Permissions: permissions, Label: "test"})
+
+	if err != nil {
+		e.t.Fatal(err)
+	}
+
+	return user.UserId, token
+}
+
+func (e *testEnv) seed(count int) {
+	for i := 0; i < count; i++ {
+		ip := "192.0.2.1"
+
+		if i%2 == 1 {
+			ip = "192.0.2.2"
+		}
+
+		e.store.AddFingerprint(fmt.Sprintf("fp-%d", i+1), ip, time.Now().Add(-time.Duration(count-i)*time.Minute))
+	}
+}
+
+func (e *testEnv) serve(r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	e.server.Handler().ServeHTTP(w, r)
+
+	return w
+}
+
+func (e *testEnv) do(method string, path string, token string, body string) *httptest.ResponseRecorder {
+	var reader io.Reader
+
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+
+	r := httptest.NewRequest(method, path, reader)
+
+	if token != "" {
+		r.Header.Set("Authorization", token)
+	}
+
+	return e.serve(r)
+}
+
+func decodeJSON(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("response is not json: %s\n%s", err, w.Body.String())
+	}
+}
+
+func expectStatus(t *testing.T, w *httptest.ResponseRecorder, status int) {
+	t.Helper()
+
+	if w.Code != status {
+		t.Fatalf("expected %d, got %d: %s", status, w.Code, w.Body.String())
+	}
+}
+
+func expectError(t *testing.T, w *httptest.ResponseRecorder, e Error) {
+	t.Helper()
+
+	expectStatus(t, w, e.Status)
+
+	var body ErrorResponse
+	decodeJSON(t, w, &body)
+
+	if body.Code != e.Code {
+		t.Fatalf("expected code %s, got %s", e.Code, body.Code)
+	}
+
+	if body.RequestID == "" {
+		t.Error("expected the error to carry a request id")
+	}
+}
+
+// every route that takes a token, and the permission it needs
+var tokenRoutes = []struct {
+	method     string
+	path       string
+	permission common.Permission
+}{
+	{http.MethodGet, "/", common.PermissionViewHomePage},
+	{http.MethodGet, "/admin", common.PermissionAdmin},
+	{http.MethodGet, "/admin/users", common.PermissionManageUsers},
+	{http.MethodPost, "/admin/users", common.PermissionManageUsers},
+	{http.MethodPost, "/admin/users/999/rotate", common.PermissionManageUsers},
+	{http.MethodDelete, "/admin/users/999", common.PermissionManageUsers},
+	{http.MethodGet, "/admin/audit", common.PermissionAdmin},
+	{http.MethodGet, "/admin/retention", common.PermissionAdmin},
+	{http.MethodGet, APIPrefix + "/fingerprints", common.PermissionUseAPI},
+	{http.MethodGet, APIPrefix + "/fingerprints/raw", common.PermissionExport},
+	{http.MethodGet, APIPrefix + "/fingerprints/export", common.PermissionExport},
+	{http.MethodGet, APIPrefix + "/fingerprints/random", common.PermissionUseAPI},
+	{http.MethodGet, APIPrefix + "/fingerprints/1", common.PermissionReadRecord},
+	{http.MethodGet, APIPrefix + "/stats", common.PermissionUseAPI},
+	{http.MethodGet, "/api/fingerprints/random", common.PermissionUseAPI},
+}
+
+func TestRoutesRequireAuth(t *testing.T) {
+	env := newTestEnv(t, NewServerOptions{})
+	_, none := env.user(0)
+
+	past := time.Now().Add(-time.Hour)
+	_, expiredToken, err := env.store.CreateUser(context.Background(), database.CreateUserOptions{Permissions: common.PermissionAll, ExpiresAt: &past})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, route := range tokenRoutes {
+		t.Run(route.method+" "+route.path, func(t *testing.T) {
+			expectError(t, env.do(route.method, route.path, "", ""), ErrUnauthorized)
+			expectError(t, env.do(route.method, route.path, strings.Repeat("x", common.TokenLength), ""), ErrUnauthorized)
+			expectError(t, env.do(route.method, route.path, none, ""), ErrForbidden)
+			expectError(t, env.do(route.method, route.path, expiredToken, ""), ErrTokenExpired)
+
+			// the one permission is enough, whatever the handler then responds
+			_, allowed := env.user(route.permission)
+			w := env.do(route.method, route.path, allowed, "")
+
+			if w.Code == http.StatusUnauthorized || w.Code == http.StatusForbidden {
+				t.Errorf("expected %s to be enough, got %d", route.permission, w.Code)
+			}
+		})
+	}
+}
+
+func TestTokenQueryParameter(t *testing.T) {
+	env := newTestEnv(t, NewServerOptions{})
+	_, token := env.user(common.PermissionViewHomePage)
+
+	w := env.do(http.MethodGet, "/?token="+url.QueryEscape(token), "", "")
+	expectStatus(t, w, http.StatusOK)
+
+	if !strings.Contains(w.Body.String(), "count: 0") {
+		t.Errorf("expected the home page to show the count, got %s", w.Body.String())
+	}
+}
+
+func TestClientCertificateAuth(t *testing.T) {
+	env := newTestEnv(t, NewServerOptions{})
+	subject := "CN=client,O=Example"
+
+	if _, _, err := env.store.CreateUser(context.Background(), database.CreateUserOptions{Permissions: common.PermissionUseAPI, CertSubject: &subject}); err != nil {
+		t.Fatal(err)
+	}
+
+	env.seed(1)
+
+	withCert := func(name pkix.Name) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, APIPrefix+"/fingerprints/random", nil)
+		r.TLS = &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{{Subject: name}}},
+		}
+
+		return r
+	}
+
+	expectStatus(t, env.serve(withCert(pkix.Name{CommonName: "client", Organization: []string{"Example"}})), http.StatusOK)
+	expectError(t, env.serve(withCert(pkix.Name{CommonName: "someone-else"})), ErrUnauthorized)
+}
+
+func TestHomeAndAdminPages(t *testing.T) {
+	env := newTestEnv(t, NewServerOptions{})
+	_, token := env.user(common.PermissionAll)
+	env.seed(3)
+
+	w := env.do(http.MethodGet, "/", token, "")
+	expectStatus(t, w, http.StatusOK)
+
+	if !strings.Contains(w.Body.String(), "count: 3") || !strings.Contains(w.Body.String(), "GET /admin/users") {
+		t.Errorf("unexpected home page:\n%s", w.Body.String())
+	}
+
+	w = env.do(http.MethodGet, "/admin", token, "")
+	expectStatus(t, w, http.StatusOK)
+
+	if !strings.Contains(w.Body.String(), "label=test") {
+		t.Errorf("expected the admin page to list the user:\n%s", w.Body.String())
+	}
+}
+
+func TestGetFingerprints(t *testing.T) {
+	env := newTestEnv(t, NewServerOptions{})
+	_, token := env.user(common.PermissionUseAPI | common.PermissionReadRecord)
+
+	expectError(t, env.do(http.MethodGet, APIPrefix+"/fingerprints/random", token, ""), ErrNoFingerprints)
+	expectError(t, env.do(http.MethodGet, APIPrefix+"/fingerprints/1", token, ""), ErrNotFound)
+
+	env.seed(2)
+
+	w := env.do(http.MethodGet, APIPrefix+"/fingerprints/random", token, "")
+	expectStatus(t, w, http.StatusOK)
+
+	w = env.do(http.MethodGet, APIPrefix+"/fingerprints/2", token, "")
+	expectStatus(t, w, http.StatusOK)
+
+	var fp GetFingerprintResponse
+	decodeJSON(t, w, &fp)
+
+	if fp.ID != 2 || fp.Fingerprint != "fp-2" || fp.ProxyIP != "192.0.2.2" {
+		t.Errorf("unexpected fingerprint %+v", fp)
+	}
+
+	if fp.CreatedAt == nil || time.Since(*fp.CreatedAt) > time.Hour {
+		t.Errorf("expected the time the fingerprint was fetched, got %v", fp.CreatedAt)
+	}
+
+	// the id pattern does not match, so no route does
+	expectError(t, env.do(http.MethodGet, APIPrefix+"/fingerprints/abc", token, ""), ErrNotFound)
+}
+
+func TestListFingerprintsPages(t *testing.T) {
+	env := newTestEnv(t, NewServerOptions{})
+	_, token := env.user(common.PermissionUseAPI)
+	env.seed(5)
+
+	var ids []uint64
+	path := APIPrefix + "/fingerprints?limit=2"
+
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatal("pagination did not finish")
+		}
+
+		w := env.do(http.MethodGet, path, token, "")
+		expectStatus(t, w, http.StatusOK)
+
+		var page ListFingerprintsResponse
+		decodeJSON(t, w, &page)
+
+		for _, item := range page.Items {
+			ids = append(ids, item.ID)
+		}
+
+		if page.NextCursor == nil {
+			break
+		}
+
+		path = APIPrefix + "/fingerprints?limit=2&cursor=" + url.QueryEscape(*page.NextCursor)
+	}
+
+	if fmt.Sprint(ids) != "[5 4 3 2 1]" {
+		t.Errorf("expected every fingerprint newest first, got %v", ids)
+	}
+
+	// pages are bounded, so they are not audited like bulk exports
+	if entries, _ := env.store.GetAuditLog(context.Background(), database.AuditLogFilter{Limit: 10}); len(entries) != 0 {
+		t.Errorf("expected no audit entries, got %+v", entries)
+	}
+
+	w := env.do(http.MethodGet, APIPrefix+"/fingerprints?proxy_ip=192.0.2.2&since_id=2", token, "")
+	expectStatus(t, w, http.StatusOK)
+
+	var filtered ListFingerprintsResponse
+	decodeJSON(t, w, &filtered)
+
+	if len(filtered.Items) != 1 || filtered.Items[0].ID != 4 {
+		t.Errorf("expected only fingerprint 4, got %+v", filtered.Items)
+	}
+
+	for _, query := range []string{"limit=0", "limit=1001", "cursor=nope", "since_id=-1"} {
+		expectError(t, env.do(http.MethodGet, APIPrefix+"/fingerprints?"+query, token, ""), ErrBadRequest)
+	}
+}
+
+func TestExportFingerprints(t *testing.T) {
+	env := newTestEnv(t, NewServerOptions{})
+	_, token := env.user(common.PermissionExport)
+	env.seed(3)
+
+	cases := []struct {
+		path        string
+		contentType string
+		lines       int
+	}{
+		{APIPrefix + "/fingerprints/export", "application/x-ndjson; charset=utf-8", 3},
+		{APIPrefix + "/fingerprints/export?format=csv", "text/csv; charset=utf-8", 4},
+		{APIPrefix + "/fingerprints/export?format=text", "text/plain; charset=utf-8", 3},
+		{APIPrefix + "/fingerprints/raw", "text/plain; charset=utf-8", 3},
+	}
+
+	for _, c := range cases {
+		w := env.do(http.MethodGet, c.path, token, "")
+		expectStatus(t, w, http.StatusOK)
+
+		if ct := w.Header().Get("Content-Type"); ct != c.contentType {
+			t.Errorf("%s: expected %s, got %s", c.path, c.contentType, ct)
+		}
+
+		if lines := strings.Count(w.Body.String(), "\n"); lines != c.lines {
+			t.Errorf("%s: expected %d lines, got %d", c.path, c.lines, lines)
+		}
+	}
+
+	expectError(t, env.do(http.MethodGet, APIPrefix+"/fingerprints/export?format=xml", token, ""), ErrBadRequest)
+}
+
+func TestDeprecatedAliases(t *testing.T) {
+	env := newTestEnv(t, NewServerOptions{})
+	_, token := env.user(common.PermissionUseAPI)
+	env.seed(1)
+
+	w := env.do(http.MethodGet, "/api/fingerprints/random", token, "")
+	expectStatus(t, w, http.StatusOK)
+
+	if w.Header().Get("Deprecation") != "true" {
+		t.Error("expected a Deprecation header")
+	}
+
+	if link := w.Header().Get("Link"); link != `<`+APIPrefix+`/fingerprints/random>; rel="successor-version"` {
+		t.Errorf("unexpected Link header %q", link)
+	}
+
+	// the aliases only answer the method of the routes they stand in for
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodDelete} {
+		expectError(t, env.do(method, "/api/fingerprints/random", token, ""), ErrMethodNotAllowed)
+	}
+}
+
+func TestStats(t *testing.T) {
+	env := newTestEnv(t, NewServerOptions{})
+	_, token := env.user(common.PermissionUseAPI)
+	env.seed(4)
+
+	w := env.do(http.MethodGet, APIPrefix+"/stats?window=24h&period=day", token, "")
+	expectStatus(t, w, http.StatusOK)
+
+	var stats StatsResponse
+	decodeJSON(t, w, &stats)
+
+	var inserted uint64
+
+	for _, bucket := range stats.Inserted {
+		inserted += bucket.Count
+	}
+
+	if stats.Count != 4 || inserted != 4 || stats.Period != "day" {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	if strings.Contains(w.Body.String(), `"proxies"`) {
+		t.Error("proxies must only be shown to callers with VIEW_PROXIES")
+	}
+
+	expectError(t, env.do(http.MethodGet, APIPrefix+"/stats?window=1000h", token, ""), ErrBadRequest)
+	expectError(t, env.do(http.MethodGet, APIPrefix+"/stats?period=week", token, ""), ErrBadRequest)
+}
+
+func TestManageUsers(t *testing.T) {
+	env := newTestEnv(t, NewServerOptions{})
+	adminId, admin := env.user(common.PermissionAll)
+
+	w := env.do(http.MethodPost, "/admin/users", admin, `{"permission_names": ["USE_API"], "label": "reader"}`)
+	expectStatus(t, w, http.StatusCreated)
+
+	var created TokenResponse
+	decodeJSON(t, w, &created)
+
+	if created.Label != "reader" || len(created.Token) != common.TokenLength || created.TokenPrefix != created.Token[:8] {
+		t.Fatalf("unexpected user %+v", created)
+	}
+
+	env.seed(1)
+	expectStatus(t, env.do(http.MethodGet, APIPrefix+"/fingerprints/random", created.Token, ""), http.StatusOK)
+
+	bad := []string{
+		`{`,
+		`{"unknown": true}`,
+		`{"permission_names": ["FLY"]}`,
+		`{"permissions": 1024}`,
+		`{"expires_at": "2000-01-01T00:00:00Z"}`,
+		`{"cert_subject": ""}`,
+	}
+
+	for _, body := range bad {
+		expectError(t, env.do(http.MethodPost, "/admin/users", admin, body), ErrBadRequest)
+	}
+
+	subject := `{"cert_subject": "CN=client"}`
+	expectStatus(t, env.do(http.MethodPost, "/admin/users", admin, subject), http.StatusCreated)
+	expectError(t, env.do(http.MethodPost, "/admin/users", admin, subject), ErrConflict)
+
+	w = env.do(http.MethodGet, "/admin/users", admin, "")
+	expectStatus(t, w, http.StatusOK)
+
+	var users []UserResponse
+	decodeJSON(t, w, &users)
+
+	if len(users) != 3 {
+		t.Fatalf("expected 3 users, got %d", len(users))
+	}
+
+	w = env.do(http.MethodPost, fmt.Sprintf("/admin/users/%d/rotate", created.ID), admin, "")
+	expectStatus(t, w, http.StatusOK)
+
+	var rotated TokenResponse
+	decodeJSON(t, w, &rotated)
+
+	expectError(t, env.do(http.MethodGet, APIPrefix+"/fingerprints/random", created.Token, ""), ErrUnauthorized)
+	expectStatus(t, env.do(http.MethodGet, APIPrefix+"/fingerprints/random", rotated.Token, ""), http.StatusOK)
+	expectError(t, env.do(http.MethodPost, "/admin/users/99/rotate", admin, ""), ErrNotFound)
+
+	expectError(t, env.do(http.MethodDelete, fmt.Sprintf("/admin/users/%d", adminId), admin, ""), ErrBadRequest)
+	expectStatus(t, env.do(http.MethodDelete, fmt.Sprintf("/admin/users/%d", created.ID), admin, ""), http.StatusNoContent)
+	expectError(t, env.do(http.MethodDelete, fmt.Sprintf("/admin/users/%d", created.ID), admin, ""), ErrNotFound)
+	expectError(t, env.do(http.MethodGet, APIPrefix+"/fingerprints/random", rotated.Token, ""), ErrUnauthorized)
+
+	expectError(t, env.do(http.MethodPut, "/admin/users", admin, ""), ErrMethodNotAllowed)
+
+	// managing users does not reach beyond the caller's own permissions
+	managerPermissions := common.PermissionManageUsers.Add(common.PermissionUseAPI)
+	_, manager := env.user(managerPermissions)
+
+	expectError(t, env.do(http.MethodPost, "/admin/users", manager, `{"permission_names": ["ADMIN"]}`), ErrForbidden)
+	expectError(t, env.do(http.MethodPost, "/admin/users", manager, fmt.Sprintf(`{"permissions": %d}`, common.PermissionAll)), ErrForbidden)
+	expectError(t, env.do(http.MethodPost, fmt.Sprintf("/admin/users/%d/rotate", adminId), manager, ""), ErrForbidden)
+	expectError(t, env.do(http.MethodDelete, fmt.Sprintf("/admin/users/%d", adminId), manager, ""), ErrForbidden)
+	expectStatus(t, env.do(http.MethodGet, APIPrefix+"/fingerprints/random", admin, ""), http.StatusOK)
+
+	w = env.do(http.MethodPost, "/admin/users", manager, `{"permission_names": ["USE_API"]}`)
+	expectStatus(t, w, http.StatusCreated)
+	decodeJSON(t, w, &created)
+
+	expectStatus(t, env.do(http.MethodPost, fmt.Sprintf("/admin/users/%d/rotate", created.ID), manager, ""), http.StatusOK)
+	expectStatus(t, env.do(http.MethodDelete, fmt.Sprintf("/admin/users/%d", created.ID), manager, ""), http.StatusNoContent)
+	expectError(t, env.do(http.MethodPost, "/admin/users/99/rotate", manager, ""), ErrNotFound)
+}
+
+func TestAuditLog(t *testing.T) {
+	env := newTestEnv(t, NewServerOptions{})
+	adminId, admin := env.user(common.PermissionAll)
+	_, exporter := env.user(common.PermissionExport)
+
+	expectStatus(t, env.do(http.MethodGet, "/admin/users", admin, ""), http.StatusOK)
+	expectStatus(t, env.do(http.MethodGet, APIPrefix+"/fingerprints/raw", exporter, ""), http.StatusOK)
+
+	// not audited
+	_, reader := env.user(common.PermissionUseAPI)
+	expectError(t, env.do(http.MethodGet, APIPrefix+"/fingerprints/random", reader, ""), ErrNoFingerprints)
+
+	w := env.do(http.MethodGet, fmt.Sprintf("/admin/audit?user_id=%d", adminId), admin, "")
+	expectStatus(t, w, http.StatusOK)
+
+	var entries []AuditLogResponse
+	decodeJSON(t, w, &entries)
+
+	if len(entries) != 1 || entries[0].Route != "/admin/users" || entries[0].Status != http.StatusOK {
+		t.Fatalf("unexpected audit log %+v", entries)
+	}
+
+	w = env.do(http.MethodGet, "/admin/audit", admin, "")
+	expectStatus(t, w, http.StatusOK)
+	decodeJSON(t, w, &entries)
+
+	// both requests above, then the audit read before this one
+	if len(entries) != 3 || entries[1].Route != APIPrefix+"/fingerprints/raw" {
+		t.Fatalf("unexpected audit log %+v", entries)
+	}
+
+	expectError(t, env.do(http.MethodGet, "/admin/audit?since=yesterday", admin, ""), ErrBadRequest)
+}
+
+func TestRateLimit(t *testing.T) {
+	env := newTestEnv(t, NewServerOptions{RateLimit: RateLimitConfig{Requests: 2, Window: time.Hour}})
+	_, token := env.user(common.PermissionUseAPI)
+	env.seed(1)
+
+	for i := 0; i < 2; i++ {
+		expectStatus(t, env.do(http.MethodGet, APIPrefix+"/fingerprints/random", token, ""), http.StatusOK)
+	}
+
+	w := env.do(http.MethodGet, APIPrefix+"/fingerprints/random", token, "")
+	expectError(t, w, ErrRateLimited)
+
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("expected a Retry-After header")
+	}
+
+	// limits are per user
+	_, other := env.user(common.PermissionUseAPI)
+	expectStatus(t, env.do(http.MethodGet, APIPrefix+"/fingerprints/random", other, ""), http.StatusOK)
+}
+
+// consoleClient keeps the session and login cookies between console requests
+type consoleClient struct {
+	env    *testEnv
+	cookie *http.Cookie
+	login  *http.Cookie
+}
+
+func (c *consoleClient) do(method string, path string, form url.Values) *httptest.ResponseRecorder {
+	var body io.Reader
+
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+
+	r := httptest.NewRequest(method, path, body)
+
+	if form != nil {
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	for _, cookie := range []*http.Cookie{c.cookie, c.login} {
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+	}
+
+	w := c.env.serve(r)
+
+	for _, cookie := range w.Result().Cookies() {
+		switch cookie.Name {
+		case consoleCookie:
+			c.cookie = cookie
+		case consoleLoginCookie:
+			c.login = cookie
+		}
+	}
+
+	return w
+}
+
+// logIn loads the login form for its CSRF token and posts token with it
+func (c *consoleClient) logIn(token string) *httptest.ResponseRecorder {
+	c.do(http.MethodGet, "/console/login", nil)
+	return c.do(http.MethodPost, "/console/login", url.Values{"csrf": {c.login.Value}, "token": {token}})
+}
+
+func expectRedirect(t *testing.T, w *httptest.ResponseRecorder, location string) {
+	t.Helper()
+
+	expectStatus(t, w, http.StatusSeeOther)
+
+	if got := w.Header().Get("Location"); got != location {
+		t.Fatalf("expected a redirect to %s, got %s", location, got)
+	}
+}
+
+func TestConsole(t *testing.T) {
+	env := newTestEnv(t, NewServerOptions{})
+	_, admin := env.user(common.PermissionAll)
+	_, viewer := env.user(common.PermissionViewHomePage)
+
+	client := &consoleClient{env: env}
+
+	expectRedirect(t, client.do(http.MethodGet, "/console", nil), "/console/login")
+	expectStatus(t, client.logIn("wrong"), http.StatusUnauthorized)
+
+	// logins without the token from the form are refused
+	expectStatus(t, client.do(http.MethodPost, "/console/login", url.Values{"token": {viewer}}), http.StatusForbidden)
+	expectStatus(t, (&consoleClient{env: env}).do(http.MethodPost, "/console/login", url.Values{"csrf": {client.login.Value}, "token": {viewer}}), http.StatusForbidden)
+
+	// viewers can see the status page but not manage users
+	expectRedirect(t, client.logIn(viewer), "/console")
+	expectStatus(t, client.do(http.MethodGet, "/console", nil), http.StatusOK)
+	expectStatus(t, client.do(http.MethodGet, "/console/users", nil), http.StatusForbidden)
+	expectStatus(t, client.do(http.MethodGet, "/console/audit", nil), http.StatusForbidden)
+
+	client = &consoleClient{env: env}
+	expectRedirect(t, client.logIn(admin), "/console")
+
+	w := client.do(http.MethodGet, "/console/users", nil)
+	expectStatus(t, w, http.StatusOK)
+
+	session, err := env.store.GetSession(context.Background(), client.cookie.Value)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	csrf := session.CsrfToken
+
+	// changes without the csrf token are refused
+	expectStatus(t, client.do(http.MethodPost, "/console/users", url.Values{"label": {"nope"}}), http.StatusForbidden)
+
+	w = client.do(http.MethodPost, "/console/users", url.Values{"csrf": {csrf}, "label": {"console-user"}, "permissions": {"USE_API"}})
+	expectStatus(t, w, http.StatusOK)
+
+	if !strings.Contains(w.Body.String(), "Created user 3") {
+		t.Fatalf("expected the new user to be shown:\n%s", w.Body.String())
+	}
+
+	expectStatus(t, client.do(http.MethodPost, "/console/users/3/rotate", url.Values{"csrf": {csrf}}), http.StatusOK)
+	expectRedirect(t, client.do(http.MethodPost, "/console/users/3/revoke", url.Values{"csrf": {csrf}}), "/console/users")
+	expectStatus(t, client.do(http.MethodPost, "/console/users/3/revoke", url.Values{"csrf": {csrf}}), http.StatusNotFound)
+	expectStatus(t, client.do(http.MethodGet, "/console/audit", nil), http.StatusOK)
+
+	expectRedirect(t, client.do(http.MethodPost, "/console/logout", url.Values{"csrf": {csrf}}), "/console/login")
+	expectRedirect(t, client.do(http.MethodGet, "/console", nil), "/console/login")
+
+	// managers cannot hand out or take over permissions they do not hold
+	_, manager := env.user(common.PermissionManageUsers)
+
+	client = &consoleClient{env: env}
+	expectRedirect(t, client.logIn(manager), "/console")
+
+	session, err = env.store.GetSession(context.Background(), client.cookie.Value)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	csrf = session.CsrfToken
+
+	expectStatus(t, client.do(http.MethodPost, "/console/users", url.Values{"csrf": {csrf}, "permissions": {"ADMIN"}}), http.StatusBadRequest)
+	expectStatus(t, client.do(http.MethodPost, "/console/users/1/rotate", url.Values{"csrf": {csrf}}), http.StatusForbidden)
+	expectStatus(t, client.do(http.MethodPost, "/console/users/1/revoke", url.Values{"csrf": {csrf}}), http.StatusForbidden)
+	expectStatus(t, client.do(http.MethodPost, "/console/users", url.Values{"csrf": {csrf}, "permissions": {"MANAGE_USERS"}}), http.StatusOK)
+}
+
+func TestConsoleSecureCookies(t *testing.T) {
+	for _, secure := range []bool{false, true} {
+		env := newTestEnv(t, NewServerOptions{SecureCookies: secure})
+		_, admin := env.user(common.PermissionAll)
+
+		client := &consoleClient{env: env}
+		expectRedirect(t, client.logIn(admin), "/console")
+
+		if client.cookie.Secure != secure || client.login.Secure != secure {
+			t.Errorf("expected secure to be %v, got session %v and login %v", secure, client.cookie.Secure, client.login.Secure)
+		}
+	}
+}
+
+// timeoutStore fails every random fingerprint lookup the way Database does once
+// the query timeout passes
+type timeoutStore struct {
+	*database.MemoryStore
+}
+
+func (s timeoutStore) GetRandomFingerprint(ctx context.Context) (database.GetFingerprintResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Millisecond)
+	defer cancel()
+
+	<-ctx.Done()
+	return database.GetFingerprintResult{}, ctx.Err()
+}
+
+func TestQueryTimeout(t *testing.T) {
+	env := newTestEnv(t, NewServerOptions{})
+	_, token := env.user(common.PermissionUseAPI)
+
+	env.server.db = timeoutStore{env.store}
+
+	w := env.do(http.MethodGet, APIPrefix+"/fingerprints/random", token, "")
+	expectError(t, w, ErrDatabaseTimeout)
+}
+
+func TestRetentionDryRun(t *testing.T) {
+	env := newTestEnv(t, NewServerOptions{Retention: database.RetentionPolicy{MaxRows: 3}})
+	_, token := env.user(common.PermissionAdmin)
+	env.seed(5)
+
+	w := env.do(http.MethodGet, "/admin/retention", token, "")
+	expectStatus(t, w, http.StatusOK)
+
+	var report RetentionResponse
+	decodeJSON(t, w, &report)
+
+	if !report.Enabled || report.MaxRows != 3 || report.WouldDelete != 2 || report.MaxID != 2 {
+		t.Errorf("unexpected report %+v", report)
+	}
+
+	// previewing a policy does not change the configured one
+	w = env.do(http.MethodGet, "/admin/retention?max_rows=0&max_age=4m30s", token, "")
+	expectStatus(t, w, http.StatusOK)
+	decodeJSON(t, w, &report)
+
+	if report.MaxAgeSeconds != 270 || report.MaxRows != 0 || report.WouldDelete != 1 {
+		t.Errorf("unexpected preview %+v", report)
+	}
+
+	expectError(t, env.do(http.MethodGet, "/admin/retention?max_age=soon", token, ""), ErrBadRequest)
+	expectError(t, env.do(http.MethodGet, "/admin/retention?max_rows=9223372036854775808", token, ""), ErrBadRequest)
+	expectStatus(t, env.do(http.MethodGet, "/admin/retention?max_rows=9223372036854775807", token, ""), http.StatusOK)
+
+	// nothing was deleted
+	if count, _ := env.store.CountFingerprints(context.Background()); count != 5 {
+		t.Errorf("expected a dry run to keep all 5 fingerprints, %d are left", count)
+	}
+}
@@ -0,0 +1,88 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/common"
+)
+
+const defaultStatsWindow = time.Hour * 24
+const maxStatsWindow = time.Hour * 24 * 31
+
+var statsPeriods = map[string]bool{
+	"hour": true,
+	"day":  true,
+}
+
+func (s *Server) HandleGetStats(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	window := defaultStatsWindow
+	period := "hour"
+
+	if value := query.Get("window"); value != "" {
+		parsed, err := time.ParseDuration(value)
+
+		if err != nil || parsed <= 0 || parsed > maxStatsWindow {
+			WriteError(w, r, ErrBadRequest.WithMessage("window must be a duration up to 744h"), nil)
+			return
+		}
+
+		window = parsed
+	}
+
+	if value := query.Get("period"); value != "" {
+		if !statsPeriods[value] {
+			WriteError(w, r, ErrBadRequest.WithMessage("period must be one of hour, day"), nil)
+			return
+		}
+
+		period = value
+	}
+
+	count, err := s.db.CountFingerprints(r.Context())
+
+	if err != nil {
+		WriteError(w, r, ErrInternal, err)
+		return
+	}
+
+	buckets, err := s.db.CountFingerprintsByPeriod(r.Context(), time.Now().Add(-window), period)
+
+	if err != nil {
+		WriteError(w, r, ErrInternal, err)
+		return
+	}
+
+	inserts := s.db.InsertStats()
+	pool := s.db.PoolStats()
+
+	out := StatsResponse{
+		Count:    count,
+		Window:   window.String(),
+		Period:   period,
+		Inserted: []StatsBucket{},
+		Listener: StatsListener{
+			Inserted:     inserts.Inserted,
+			InsertErrors: inserts.Failed,
+		},
+		Pool: StatsPoolResponse{
+			TotalConns:    pool.TotalConns,
+			IdleConns:     pool.IdleConns,
+			AcquiredConns: pool.AcquiredConns,
+			MaxConns:      pool.MaxConns,
+			AcquireCount:  pool.AcquireCount,
+			AcquireWaitMs: pool.AcquireWait.Milliseconds(),
+		},
+	}
+
+	for _, bucket := range buckets {
+		out.Inserted = append(out.Inserted, StatsBucket{Start: bucket.Start, Count: bucket.Count})
+	}
+
+	if principal, ok := PrincipalFromContext(r.Context()); ok && principal.Permissions.Has(common.PermissionViewProxies) && s.pm != nil {
+		out.Proxies = s.pm.IPs()
+	}
+
+	WriteJSON(w, r, out, http.StatusOK)
+}
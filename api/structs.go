@@ -1,17 +1,120 @@
 package api
 
+import "time"
+
 type StatsResponse struct {
-	Count   uint64   `json:"count"`
-	Proxies []string `json:"proxies"`
+	Count uint64 `json:"count"`
+	// only present for callers that can view proxies
+	Proxies []string `json:"proxies,omitempty"`
+
+	Window   string            `json:"window"`
+	Period   string            `json:"period"`
+	Inserted []StatsBucket     `json:"inserted"`
+	Listener StatsListener     `json:"listener"`
+	Pool     StatsPoolResponse `json:"pool"`
+}
+
+type StatsBucket struct {
+	Start time.Time `json:"start"`
+	Count uint64    `json:"count"`
+}
+
+// counts since this instance started
+type StatsListener struct {
+	Inserted     uint64 `json:"inserted"`
+	InsertErrors uint64 `json:"insert_errors"`
+}
+
+type StatsPoolResponse struct {
+	TotalConns    int32 `json:"total_conns"`
+	IdleConns     int32 `json:"idle_conns"`
+	AcquiredConns int32 `json:"acquired_conns"`
+	MaxConns      int32 `json:"max_conns"`
+	AcquireCount  int64 `json:"acquire_count"`
+	AcquireWaitMs int64 `json:"acquire_wait_ms"`
 }
 
 type GetFingerprintResponse struct {
-	ID          uint64 `json:"id"`
-	Fingerprint string `json:"fingerprint"`
-	ProxyIP     string `json:"proxy_ip"`
+	ID          uint64     `json:"id"`
+	Fingerprint string     `json:"fingerprint"`
+	ProxyIP     string     `json:"proxy_ip"`
+	CreatedAt   *time.Time `json:"created_at"`
+}
+
+type ListFingerprintsResponse struct {
+	Items      []GetFingerprintResponse `json:"items"`
+	NextCursor *string                  `json:"next_cursor"`
 }
 
 type ErrorResponse struct {
-	Error string  `json:"message"`
-	Code  *string `json:"code,omitempty"`
+	Error     string `json:"message"`
+	Code      string `json:"code"`
+	RequestID string `json:"request_id"`
+}
+
+type UserResponse struct {
+	ID          uint64     `json:"id"`
+	Permissions uint32     `json:"permissions"`
+	Names       []string   `json:"permission_names"`
+	TokenPrefix string     `json:"token_prefix"`
+	Label       string     `json:"label"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	LastUsedAt  *time.Time `json:"last_used_at"`
+	CertSubject *string    `json:"cert_subject"`
+}
+
+type CreateUserRequest struct {
+	// either a bitmask, or the names of the permissions
+	Permissions     uint32     `json:"permissions"`
+	PermissionNames []string   `json:"permission_names"`
+	Label           string     `json:"label"`
+	ExpiresAt       *time.Time `json:"expires_at"`
+	// the subject of a client certificate that also authenticates as the user,
+	// for example "CN=scraper-client,O=Example"
+	CertSubject *string `json:"cert_subject"`
+}
+
+type TokenResponse struct {
+	UserResponse
+	Token string `json:"token"`
+}
+
+type AuditLogResponse struct {
+	ID         uint64    `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	RequestID  string    `json:"request_id"`
+	UserID     uint64    `json:"user_id"`
+	Method     string    `json:"method"`
+	Route      string    `json:"route"`
+	Status     int       `json:"status"`
+	DurationMs int64     `json:"duration_ms"`
+	RemoteAddr string    `json:"remote_addr"`
+}
+
+type HealthResponse struct {
+	// ok, or unavailable if any check failed
+	Status string                `json:"status"`
+	Checks map[string]ReadyCheck `json:"checks,omitempty"`
+}
+
+type ReadyCheck struct {
+	OK       bool   `json:"ok"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration,omitempty"`
+
+	// only set for the migrations check
+	Version  *int64 `json:"version,omitempty"`
+	Expected *int64 `json:"expected,omitempty"`
+}
+
+type RetentionResponse struct {
+	Enabled       bool   `json:"enabled"`
+	MaxAgeSeconds uint64 `json:"max_age_seconds"`
+	MaxRows       uint64 `json:"max_rows"`
+	// what a run of the retention job would delete now
+	WouldDelete uint64     `json:"would_delete"`
+	MaxID       uint64     `json:"max_id"`
+	Oldest      *time.Time `json:"oldest"`
+	Newest      *time.Time `json:"newest"`
 }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/database"
+	"go.uber.org/zap"
+)
+
+const commandUsage = `commands:
+  admin bootstrap    creates the first admin user and prints its token
+  migrate up         applies every migration the database is missing
+  migrate down       rolls back the most recently applied migration
+  migrate status     lists the migrations and when each was applied`
+
+// runCommand handles the subcommands given after the flags, returning the exit code
+func runCommand(ctx context.Context, dbUrl string, args []string) int {
+	switch strings.Join(args, " ") {
+	case "admin bootstrap":
+		return runAdminBootstrap(ctx, dbUrl)
+	case "migrate up":
+		return runMigrateUp(ctx, dbUrl)
+	case "migrate down":
+		return runMigrateDown(ctx, dbUrl)
+	case "migrate status":
+		return runMigrateStatus(ctx, dbUrl)
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command: %s\n%s\n", strings.Join(args, " "), commandUsage)
+	return 2
+}
+
+func runAdminBootstrap(ctx context.Context, dbUrl string) int {
+	log := zap.L().Named("bootstrap")
+
+	db, err := database.Open(ctx, database.NewDatabaseOptions{URL: dbUrl, QueryTimeout: *QueryTimeout})
+
+	if err != nil {
+		log.Error("could not open db connection", zap.Error(err))
+		return 1
+	}
+
+	user, token, err := db.BootstrapAdmin(ctx)
+
+	if err != nil && errors.Is(err, database.ErrAdminExists) {
+		log.Error("an admin user already exists, use its token to create further users via /admin/users")
+		return 1
+	}
+
+	if err != nil {
+		log.Error("could not create admin user", zap.Error(err))
+		return 1
+	}
+
+	log.Info("created admin user", zap.Uint64("user", user.UserId))
+
+	// the token is only stored hashed, so this is the only time it can be seen
+	fmt.Println(token)
+
+	return 0
+}
+
+func runMigrateUp(ctx context.Context, dbUrl string) int {
+	log := zap.L().Named("migrate")
+
+	db, err := database.Open(ctx, database.NewDatabaseOptions{URL: dbUrl, QueryTimeout: *QueryTimeout})
+
+	if err != nil {
+		log.Error("could not open db connection", zap.Error(err))
+		return 1
+	}
+
+	applied, err := db.MigrateUp(ctx)
+
+	if err != nil {
+		log.Error("could not apply migrations", zap.Error(err))
+		return 1
+	}
+
+	if len(applied) == 0 {
+		log.Info("already up to date")
+	}
+
+	return 0
+}
+
+func runMigrateDown(ctx context.Context, dbUrl string) int {
+	log := zap.L().Named("migrate")
+
+	db, err := database.Open(ctx, database.NewDatabaseOptions{URL: dbUrl, QueryTimeout: *QueryTimeout})
+
+	if err != nil {
+		log.Error("could not open db connection", zap.Error(err))
+		return 1
+	}
+
+	if _, err := db.MigrateDown(ctx); err != nil {
+		log.Error("could not roll back", zap.Error(err))
+		return 1
+	}
+
+	return 0
+}
+
+func runMigrateStatus(ctx context.Context, dbUrl string) int {
+	log := zap.L().Named("migrate")
+
+	db, err := database.Open(ctx, database.NewDatabaseOptions{URL: dbUrl, QueryTimeout: *QueryTimeout})
+
+	if err != nil {
+		log.Error("could not open db connection", zap.Error(err))
+		return 1
+	}
+
+	states, err := db.MigrationStatus(ctx)
+
+	if err != nil {
+		log.Error("could not read migration status", zap.Error(err))
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+
+	for _, state := range states {
+		applied := "pending"
+
+		if state.AppliedAt != nil {
+			applied = state.AppliedAt.Format(time.RFC3339)
+		}
+
+		fmt.Fprintf(w, "%d\t%s\t%s\n", state.Version, state.Name, applied)
+	}
+
+	w.Flush()
+	return 0
+}
@@ -6,8 +6,18 @@ import (
 	"fmt"
 )
 
+// TokenLength is the length of the tokens handed out by GenerateToken
+const TokenLength = 32
+
 func GenerateID(prefix string) string {
 	bytes := make([]byte, 16)
 	crand.Read(bytes)
 	return fmt.Sprintf("%s_%s", prefix, base64.RawURLEncoding.EncodeToString(bytes))
 }
+
+// GenerateToken returns a random API token, TokenLength characters long
+func GenerateToken() string {
+	bytes := make([]byte, TokenLength/4*3)
+	crand.Read(bytes)
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
@@ -1,13 +1,46 @@
 package common
 
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
 type Permission uint32
 
 const (
 	PermissionViewHomePage Permission = 1 << iota
 	PermissionUseAPI
 	PermissionAdmin
+	PermissionViewProxies
+	PermissionManageUsers
+	PermissionExport
+	PermissionReadRecord
 )
 
+// PermissionAll is every permission that exists
+const PermissionAll = PermissionViewHomePage | PermissionUseAPI | PermissionAdmin |
+	PermissionViewProxies | PermissionManageUsers | PermissionExport | PermissionReadRecord
+
+// the name used for a set with no permissions in it
+const permissionNone = "NONE"
+
+var ErrUnknownPermission = errors.New("unknown permission")
+
+// in the order they are listed
+var permissionNames = []struct {
+	perm Permission
+	name string
+}{
+	{PermissionViewHomePage, "VIEW_HOME_PAGE"},
+	{PermissionUseAPI, "USE_API"},
+	{PermissionAdmin, "ADMIN"},
+	{PermissionViewProxies, "VIEW_PROXIES"},
+	{PermissionManageUsers, "MANAGE_USERS"},
+	{PermissionExport, "EXPORT"},
+	{PermissionReadRecord, "READ_RECORD"},
+}
+
 func (p Permission) Has(perm Permission) bool {
 	return (p & perm) == perm
 }
@@ -20,20 +53,59 @@ func (p Permission) Add(perm Permission) Permission {
 	return p | perm
 }
 
+// Valid reports whether every bit set is a known permission
+func (p Permission) Valid() bool {
+	return p.Remove(PermissionAll) == 0
+}
+
 func (p Permission) List() []string {
 	out := []string{}
 
-	if p.Has(PermissionViewHomePage) {
-		out = append(out, "VIEW_HOME_PAGE")
+	for _, entry := range permissionNames {
+		if p.Has(entry.perm) {
+			out = append(out, entry.name)
+		}
 	}
 
-	if p.Has(PermissionUseAPI) {
-		out = append(out, "USE_API")
+	return out
+}
+
+// String formats the permissions so that they can be read back with ParsePermissions
+func (p Permission) String() string {
+	if p == 0 {
+		return permissionNone
 	}
 
-	if p.Has(PermissionAdmin) {
-		out = append(out, "ADMIN")
+	return strings.Join(p.List(), "|")
+}
+
+// ParsePermissions accepts the names returned by Permission.List, separated by
+// commas, pipes or whitespace (optionally wrapped in parentheses), and returns
+// the set they describe
+func ParsePermissions(s string) (Permission, error) {
+	var out Permission
+
+	fields := strings.FieldsFunc(strings.Trim(strings.TrimSpace(s), "()"), func(r rune) bool {
+		return r == ',' || r == '|' || r == ' ' || r == '\t' || r == '\n'
+	})
+
+Fields:
+	for _, field := range fields {
+		name := strings.ToUpper(field)
+
+		if name == permissionNone {
+			continue
+		}
+
+		for _, entry := range permissionNames {
+			if entry.name == name {
+				out = out.Add(entry.perm)
+				continue Fields
+			}
+		}
+
+		return 0, fmt.Errorf("%w: %s", ErrUnknownPermission, field)
 	}
 
-	return out
+	return out, nil
 }
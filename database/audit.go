@@ -0,0 +1,70 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/metrics"
+)
+
+func (db *Database) AddAuditLog(ctx context.Context, entry AuditLogEntry) error {
+	defer metrics.ObserveQuery("AddAuditLog", time.Now())
+
+	ctx, cancel := db.withQueryTimeout(ctx)
+	defer cancel()
+
+	_, err := db.Conn.Exec(
+		ctx,
+		"INSERT INTO audit_log (request_id, user_id, method, route, status, duration_ms, remote_addr) VALUES ($1, $2, $3, $4, $5, $6, $7);",
+		entry.RequestID, entry.UserId, entry.Method, entry.Route, entry.Status, entry.Duration.Milliseconds(), entry.RemoteAddr,
+	)
+
+	return err
+}
+
+// GetAuditLog returns the newest entries matching the filter, newest first
+func (db *Database) GetAuditLog(ctx context.Context, filter AuditLogFilter) ([]AuditLogEntry, error) {
+	defer metrics.ObserveQuery("GetAuditLog", time.Now())
+
+	ctx, cancel := db.withQueryTimeout(ctx)
+	defer cancel()
+
+	var out []AuditLogEntry
+
+	rows, err := db.Conn.Query(
+		ctx,
+		`SELECT id, created_at, request_id, user_id, method, route, status, duration_ms, remote_addr FROM audit_log
+		WHERE ($1::timestamptz IS NULL OR created_at >= $1)
+			AND ($2::timestamptz IS NULL OR created_at < $2)
+			AND ($3::bigint IS NULL OR user_id = $3)
+		ORDER BY created_at DESC, id DESC
+		LIMIT $4`,
+		filter.Since, filter.Until, filter.UserId, filter.Limit,
+	)
+
+	if err != nil {
+		return out, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var data AuditLogEntry
+		var durationMs int64
+
+		err = rows.Scan(&data.ID, &data.CreatedAt, &data.RequestID, &data.UserId, &data.Method, &data.Route, &data.Status, &durationMs, &data.RemoteAddr)
+
+		if err != nil {
+			return out, err
+		}
+
+		data.Duration = time.Duration(durationMs) * time.Millisecond
+		out = append(out, data)
+	}
+
+	if rows.Err() != nil {
+		return out, rows.Err()
+	}
+
+	return out, err
+}
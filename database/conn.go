@@ -3,24 +3,46 @@ package database
 import (
 	"context"
 	"errors"
+	"time"
 
 	"github.com/getaddrinfo/proxy-fingerprint-scraper/common"
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"go.uber.org/zap"
 )
 
 var ErrorNotListening = errors.New("database chan is not being listened to")
 
+// DefaultQueryTimeout is used when NewDatabaseOptions.QueryTimeout is zero
+const DefaultQueryTimeout = time.Second * 10
+
+// postgres cancelled the statement, usually because of statement_timeout
+const queryCanceledCode = "57014"
+
 type Database struct {
 	Conn *pgxpool.Pool
 	ctx  context.Context
 	log  *zap.Logger
+
+	queryTimeout time.Duration
+
+	lastUsed *lastUsedFlusher
+
+	inserts insertCounts
+}
+
+type NewDatabaseOptions struct {
+	URL string
+
+	// the longest a single query may take before it is cancelled and
+	// reported as a timeout, DefaultQueryTimeout if zero
+	QueryTimeout time.Duration
 }
 
-func NewDatabase(ctx context.Context, url string) (*Database, error) {
+func NewDatabase(ctx context.Context, options NewDatabaseOptions) (*Database, error) {
 	log := zap.L().Named("db")
 
-	conn, err := pgxpool.Connect(ctx, url)
+	conn, err := pgxpool.Connect(ctx, options.URL)
 
 	if err != nil {
 		log.Error(err.Error())
@@ -29,25 +51,73 @@ func NewDatabase(ctx context.Context, url string) (*Database, error) {
 
 	log.Info("connected")
 
-	return &Database{Conn: conn, ctx: ctx, log: log}, nil
+	db := &Database{
+		Conn:         conn,
+		ctx:          ctx,
+		log:          log,
+		queryTimeout: options.QueryTimeout,
+	}
+
+	if db.queryTimeout <= 0 {
+		db.queryTimeout = DefaultQueryTimeout
+	}
+
+	db.lastUsed = newLastUsedFlusher(log, db.writeLastUsed)
+	go db.lastUsed.run(ctx)
+
+	return db, nil
 }
 
+// withQueryTimeout bounds ctx by the query timeout, every query method runs
+// under it so that a slow database cannot hold a request open forever
+func (db *Database) withQueryTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, db.queryTimeout)
+}
+
+// IsTimeout reports whether err came from a query that ran out of time, either
+// because its context expired or because postgres cancelled it. sqlite does
+// not say why it stopped a statement, so any interrupt counts.
+func IsTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || isSqliteInterrupt(err) {
+		return true
+	}
+
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == queryCanceledCode
+}
+
+// Close waits for the background work started by NewDatabase to finish, writes
+// out any pending last used times, then closes every connection in the pool. It
+// blocks until the context given to NewDatabase is done, and must be called
+// after the last request using the database has finished.
+func (db *Database) Close() {
+	db.lastUsed.close()
+	db.Conn.Close()
+
+	db.log.Info("closed")
+}
+
+// ListenForNewFingerprints stores the results sent on channel until the
+// database context is done. The channel is left open, the senders own it.
 func (db *Database) ListenForNewFingerprints(channel common.FingerprintResultChannel) {
-Iter:
-	for {
-		select {
-		case <-db.ctx.Done():
-			close(channel)
-			break Iter
-
-		case r := <-channel:
-			added, err := db.AddFingerprint(r.Fingerprint, r.ProxyIP)
-
-			if err != nil {
-				db.log.Sugar().Errorf("error: %s", err.Error())
-			}
-
-			db.log.Debug("completed process", zap.Bool("success", added))
-		}
+	listenForFingerprints(db.ctx, db.log, channel, &db.inserts, db.AddFingerprint)
+}
+
+// InsertStats returns how many fingerprints ListenForNewFingerprints has
+// stored, and failed to store, since this process started
+func (db *Database) InsertStats() InsertStats {
+	return db.inserts.stats()
+}
+
+func (db *Database) PoolStats() PoolStats {
+	stat := db.Conn.Stat()
+
+	return PoolStats{
+		TotalConns:    stat.TotalConns(),
+		IdleConns:     stat.IdleConns(),
+		AcquiredConns: stat.AcquiredConns(),
+		MaxConns:      stat.MaxConns(),
+		AcquireCount:  stat.AcquireCount(),
+		AcquireWait:   stat.AcquireDuration(),
 	}
 }
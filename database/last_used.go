@@ -0,0 +1,119 @@
+package database
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/metrics"
+	"go.uber.org/zap"
+)
+
+// how often pending last used times are written to the database
+const lastUsedFlushInterval = time.Second * 30
+
+// lastUsedFlusher buffers the times users authenticate at and writes them out
+// in the background, so that recording one never slows down a request. Both
+// backends use it, sqlite especially must not take its single write lock on
+// every authenticated request.
+type lastUsedFlusher struct {
+	log *zap.Logger
+	// stores the time a user was last seen at, unless a later one is stored
+	write func(ctx context.Context, userId uint64, at time.Time) error
+
+	mu      sync.Mutex
+	pending map[uint64]time.Time
+	// closed once run has returned
+	done chan struct{}
+}
+
+func newLastUsedFlusher(log *zap.Logger, write func(ctx context.Context, userId uint64, at time.Time) error) *lastUsedFlusher {
+	return &lastUsedFlusher{
+		log:     log,
+		write:   write,
+		pending: map[uint64]time.Time{},
+		done:    make(chan struct{}),
+	}
+}
+
+func (f *lastUsedFlusher) mark(userId uint64) {
+	f.mu.Lock()
+	f.pending[userId] = time.Now()
+	f.mu.Unlock()
+}
+
+// run flushes on an interval until ctx is done
+func (f *lastUsedFlusher) run(ctx context.Context) {
+	defer close(f.done)
+
+	ticker := time.NewTicker(lastUsedFlushInterval)
+	defer ticker.Stop()
+
+Iter:
+	for {
+		select {
+		case <-ctx.Done():
+			break Iter
+
+		case <-ticker.C:
+			f.flush(context.Background())
+		}
+	}
+}
+
+func (f *lastUsedFlusher) flush(ctx context.Context) {
+	defer metrics.ObserveQuery("flushLastUsed", time.Now())
+
+	f.mu.Lock()
+	pending := f.pending
+	f.pending = map[uint64]time.Time{}
+	f.mu.Unlock()
+
+	for userId, at := range pending {
+		if err := f.write(ctx, userId, at); err != nil {
+			f.log.Warn("could not update last used time", zap.Uint64("user", userId), zap.Error(err))
+		}
+	}
+}
+
+// close waits for run to return, then writes out what is still pending
+func (f *lastUsedFlusher) close() {
+	<-f.done
+
+	// the root context is gone by now, so give the final flush its own deadline
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+
+	f.flush(ctx)
+}
+
+// MarkUsed records that the user has just authenticated. The write is buffered
+// and flushed in the background so it never slows down the request.
+func (db *Database) MarkUsed(userId uint64) {
+	db.lastUsed.mark(userId)
+}
+
+func (db *Database) writeLastUsed(ctx context.Context, userId uint64, at time.Time) error {
+	_, err := db.Conn.Exec(
+		ctx,
+		"UPDATE auth SET last_used_at = $2 WHERE user_id = $1 AND (last_used_at IS NULL OR last_used_at < $2);",
+		userId, at,
+	)
+
+	return err
+}
+
+// MarkUsed records that the user has just authenticated, see Database.MarkUsed
+func (s *SQLiteStore) MarkUsed(userId uint64) {
+	s.lastUsed.mark(userId)
+}
+
+func (s *SQLiteStore) writeLastUsed(ctx context.Context, userId uint64, at time.Time) error {
+	_, err := s.Conn.ExecContext(
+		ctx,
+		"UPDATE auth SET last_used_at = ?2 WHERE user_id = ?1 AND (last_used_at IS NULL OR last_used_at < ?2);",
+		userId, at.UTC(),
+	)
+
+	return err
+}
@@ -0,0 +1,593 @@
+package database
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/common"
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/migrate"
+)
+
+// MemoryStore keeps everything in memory and loses it on exit. It behaves like
+// Database as far as the api can tell, so handlers can be tested without
+// postgres and the service can be tried out locally.
+type MemoryStore struct {
+	mu sync.Mutex
+
+	// ordered by id, oldest first
+	fingerprints      []GetFingerprintResult
+	lastFingerprintID uint64
+
+	users      map[uint64]*memoryUser
+	lastUserId uint64
+	sessions   map[string]*memorySession
+
+	audit       []AuditLogEntry
+	lastAuditID uint64
+
+	rateLimits map[rateLimitKey]uint64
+}
+
+type memoryUser struct {
+	GetUserResult
+	token hashedToken
+}
+
+type memorySession struct {
+	GetSessionResult
+}
+
+type rateLimitKey struct {
+	userId uint64
+	bucket string
+	start  time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:      map[uint64]*memoryUser{},
+		sessions:   map[string]*memorySession{},
+		rateLimits: map[rateLimitKey]uint64{},
+	}
+}
+
+// AddFingerprint stores a fingerprint as if it had been fetched at the given
+// time, for seeding the store
+func (m *MemoryStore) AddFingerprint(fp string, ip string, at time.Time) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastFingerprintID++
+
+	m.fingerprints = append(m.fingerprints, GetFingerprintResult{
+		ID:          m.lastFingerprintID,
+		Fingerprint: fp,
+		ProxyIP:     ip,
+		CreatedAt:   &at,
+	})
+
+	return m.lastFingerprintID
+}
+
+func (m *MemoryStore) CountFingerprints(ctx context.Context) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return uint64(len(m.fingerprints)), nil
+}
+
+func (m *MemoryStore) CountFingerprintsByPeriod(ctx context.Context, since time.Time, period string) ([]InsertBucket, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	truncate := time.Hour
+
+	if period == "day" {
+		truncate = time.Hour * 24
+	}
+
+	counts := map[time.Time]uint64{}
+
+	for _, fp := range m.fingerprints {
+		if fp.CreatedAt == nil || fp.CreatedAt.Before(since) {
+			continue
+		}
+
+		counts[fp.CreatedAt.UTC().Truncate(truncate)]++
+	}
+
+	var out []InsertBucket
+
+	for start, count := range counts {
+		out = append(out, InsertBucket{Start: start, Count: count})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Start.Before(out[j].Start)
+	})
+
+	return out, nil
+}
+
+func (m *MemoryStore) GetRandomFingerprint(ctx context.Context) (GetFingerprintResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.fingerprints) == 0 {
+		return GetFingerprintResult{}, ErrFingerprintNotFound
+	}
+
+	return m.fingerprints[rand.Intn(len(m.fingerprints))], nil
+}
+
+func (m *MemoryStore) GetSpecificFingerprint(ctx context.Context, id uint64) (GetFingerprintResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, fp := range m.fingerprints {
+		if fp.ID == id {
+			return fp, nil
+		}
+	}
+
+	return GetFingerprintResult{}, ErrFingerprintNotFound
+}
+
+func (m *MemoryStore) ListFingerprints(ctx context.Context, options ListFingerprintsOptions) ([]GetFingerprintResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var out []GetFingerprintResult
+
+	for i := len(m.fingerprints) - 1; i >= 0 && uint64(len(out)) < options.Limit; i-- {
+		fp := m.fingerprints[i]
+
+		if options.BeforeID != nil && fp.ID >= *options.BeforeID {
+			continue
+		}
+
+		if options.SinceID != nil && fp.ID <= *options.SinceID {
+			continue
+		}
+
+		if options.ProxyIP != nil && fp.ProxyIP != *options.ProxyIP {
+			continue
+		}
+
+		out = append(out, fp)
+	}
+
+	return out, nil
+}
+
+func (m *MemoryStore) StreamFingerprints(ctx context.Context, fn func(GetFingerprintResult) error) error {
+	// copied so that fn can take as long as it likes without holding the lock
+	m.mu.Lock()
+	fingerprints := make([]GetFingerprintResult, len(m.fingerprints))
+	copy(fingerprints, m.fingerprints)
+	m.mu.Unlock()
+
+	for i := len(fingerprints) - 1; i >= 0; i-- {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := fn(fingerprints[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *MemoryStore) CheckRetention(ctx context.Context, policy RetentionPolicy) (RetentionReport, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var out RetentionReport
+
+	if policy.MaxAge > 0 {
+		cutoff := time.Now().Add(-policy.MaxAge)
+
+		for _, fp := range m.fingerprints {
+			if (fp.CreatedAt == nil || fp.CreatedAt.Before(cutoff)) && fp.ID > out.MaxID {
+				out.MaxID = fp.ID
+			}
+		}
+	}
+
+	if policy.MaxRows > 0 && uint64(len(m.fingerprints)) > policy.MaxRows {
+		if id := m.fingerprints[uint64(len(m.fingerprints))-policy.MaxRows-1].ID; id > out.MaxID {
+			out.MaxID = id
+		}
+	}
+
+	for _, fp := range m.fingerprints {
+		if fp.ID > out.MaxID {
+			break
+		}
+
+		out.Count++
+
+		if fp.CreatedAt == nil {
+			continue
+		}
+
+		createdAt := *fp.CreatedAt
+
+		if out.Oldest == nil || createdAt.Before(*out.Oldest) {
+			out.Oldest = &createdAt
+		}
+
+		if out.Newest == nil || createdAt.After(*out.Newest) {
+			out.Newest = &createdAt
+		}
+	}
+
+	return out, nil
+}
+
+func (m *MemoryStore) DeleteFingerprintsUpTo(ctx context.Context, maxID uint64, limit uint64) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var deleted uint64
+
+	for deleted < limit && deleted < uint64(len(m.fingerprints)) && m.fingerprints[deleted].ID <= maxID {
+		deleted++
+	}
+
+	m.fingerprints = m.fingerprints[deleted:]
+
+	return deleted, nil
+}
+
+// authResult checks the expiry of a user that has been matched by token or
+// certificate, the lock must be held
+func (m *MemoryStore) authResult(user *memoryUser) (GetAuthResult, error) {
+	if user.ExpiresAt != nil && !time.Now().Before(*user.ExpiresAt) {
+		return GetAuthResult{}, ErrTokenExpired
+	}
+
+	return GetAuthResult{Valid: true, UserId: user.UserId, Permissions: user.Permissions}, nil
+}
+
+func (m *MemoryStore) CheckAuthValid(ctx context.Context, token string) (GetAuthResult, error) {
+	if len(token) != common.TokenLength {
+		return GetAuthResult{Valid: false}, nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, user := range m.users {
+		if user.token.Prefix == tokenPrefix(token) && verifyToken(token, user.token.Salt, user.token.Hash) {
+			return m.authResult(user)
+		}
+	}
+
+	return GetAuthResult{Valid: false}, nil
+}
+
+func (m *MemoryStore) CheckCertAuth(ctx context.Context, subject string) (GetAuthResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, user := range m.users {
+		if user.CertSubject != nil && *user.CertSubject == subject {
+			return m.authResult(user)
+		}
+	}
+
+	return GetAuthResult{Valid: false}, nil
+}
+
+func (m *MemoryStore) MarkUsed(userId uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if user, ok := m.users[userId]; ok {
+		now := time.Now()
+		user.LastUsedAt = &now
+	}
+}
+
+func (m *MemoryStore) GetAllUsers(ctx context.Context) ([]GetUserResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var out []GetUserResult
+
+	for _, user := range m.users {
+		out = append(out, user.GetUserResult)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].UserId < out[j].UserId
+	})
+
+	return out, nil
+}
+
+func (m *MemoryStore) GetUser(ctx context.Context, userId uint64) (GetUserResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userId]
+
+	if !ok {
+		return GetUserResult{}, ErrUserNotFound
+	}
+
+	return user.GetUserResult, nil
+}
+
+// hasAdmin must be called with the lock held
+func (m *MemoryStore) hasAdmin() bool {
+	for _, user := range m.users {
+		if user.Permissions.Has(common.PermissionAdmin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (m *MemoryStore) HasAdmin(ctx context.Context) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.hasAdmin(), nil
+}
+
+// addUser must be called with the lock held
+func (m *MemoryStore) addUser(options CreateUserOptions) (GetUserResult, string, error) {
+	if options.CertSubject != nil {
+		for _, user := range m.users {
+			if user.CertSubject != nil && *user.CertSubject == *options.CertSubject {
+				return GetUserResult{}, "", ErrCertSubjectTaken
+			}
+		}
+	}
+
+	token := common.GenerateToken()
+	hashed, err := newHashedToken(token)
+
+	if err != nil {
+		return GetUserResult{}, "", err
+	}
+
+	// ids are not reused once a user is revoked, as in postgres
+	m.lastUserId++
+
+	user := &memoryUser{
+		GetUserResult: GetUserResult{
+			UserId:      m.lastUserId,
+			Permissions: options.Permissions,
+			TokenPrefix: hashed.Prefix,
+			Label:       options.Label,
+			CreatedAt:   time.Now(),
+			ExpiresAt:   options.ExpiresAt,
+			CertSubject: options.CertSubject,
+		},
+		token: hashed,
+	}
+
+	m.users[user.UserId] = user
+	return user.GetUserResult, token, nil
+}
+
+func (m *MemoryStore) BootstrapAdmin(ctx context.Context) (GetUserResult, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.hasAdmin() {
+		return GetUserResult{}, "", ErrAdminExists
+	}
+
+	return m.addUser(CreateUserOptions{
+		Permissions: common.PermissionAll,
+		Label:       "bootstrap",
+	})
+}
+
+func (m *MemoryStore) CreateUser(ctx context.Context, options CreateUserOptions) (GetUserResult, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.addUser(options)
+}
+
+// deleteSessions must be called with the lock held
+func (m *MemoryStore) deleteSessions(userId uint64) {
+	for id, session := range m.sessions {
+		if session.UserId == userId {
+			delete(m.sessions, id)
+		}
+	}
+}
+
+func (m *MemoryStore) RotateToken(ctx context.Context, userId uint64) (GetUserResult, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userId]
+
+	if !ok {
+		return GetUserResult{}, "", ErrUserNotFound
+	}
+
+	token := common.GenerateToken()
+	hashed, err := newHashedToken(token)
+
+	if err != nil {
+		return GetUserResult{}, "", err
+	}
+
+	user.token = hashed
+	user.TokenPrefix = hashed.Prefix
+	m.deleteSessions(userId)
+
+	return user.GetUserResult, token, nil
+}
+
+func (m *MemoryStore) RevokeUser(ctx context.Context, userId uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.users[userId]; !ok {
+		return ErrUserNotFound
+	}
+
+	delete(m.users, userId)
+	m.deleteSessions(userId)
+
+	return nil
+}
+
+func (m *MemoryStore) HitRateLimit(ctx context.Context, userId uint64, windowStart time.Time, dayStart time.Time) (RateLimitCounts, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	window := rateLimitKey{userId: userId, bucket: "window", start: windowStart}
+	day := rateLimitKey{userId: userId, bucket: "day", start: dayStart}
+
+	m.rateLimits[window]++
+	m.rateLimits[day]++
+
+	out := RateLimitCounts{Window: m.rateLimits[window], Day: m.rateLimits[day]}
+
+	if out.Window == 1 {
+		for key := range m.rateLimits {
+			if key.userId == userId && key != window && key != day {
+				delete(m.rateLimits, key)
+			}
+		}
+	}
+
+	return out, nil
+}
+
+func (m *MemoryStore) AddAuditLog(ctx context.Context, entry AuditLogEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastAuditID++
+	entry.ID = m.lastAuditID
+	entry.CreatedAt = time.Now()
+	// postgres only keeps milliseconds
+	entry.Duration = entry.Duration.Truncate(time.Millisecond)
+
+	m.audit = append(m.audit, entry)
+	return nil
+}
+
+func (m *MemoryStore) GetAuditLog(ctx context.Context, filter AuditLogFilter) ([]AuditLogEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var out []AuditLogEntry
+
+	for i := len(m.audit) - 1; i >= 0 && uint64(len(out)) < filter.Limit; i-- {
+		entry := m.audit[i]
+
+		if filter.Since != nil && entry.CreatedAt.Before(*filter.Since) {
+			continue
+		}
+
+		if filter.Until != nil && !entry.CreatedAt.Before(*filter.Until) {
+			continue
+		}
+
+		if filter.UserId != nil && entry.UserId != *filter.UserId {
+			continue
+		}
+
+		out = append(out, entry)
+	}
+
+	return out, nil
+}
+
+func (m *MemoryStore) CreateSession(ctx context.Context, userId uint64, ttl time.Duration) (GetSessionResult, string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	user, ok := m.users[userId]
+
+	if !ok {
+		return GetSessionResult{}, "", ErrUserNotFound
+	}
+
+	for key, session := range m.sessions {
+		if session.ExpiresAt.Before(time.Now()) {
+			delete(m.sessions, key)
+		}
+	}
+
+	id := common.GenerateToken()
+
+	session := &memorySession{
+		GetSessionResult: GetSessionResult{
+			UserId:      userId,
+			Permissions: user.Permissions,
+			CsrfToken:   common.GenerateToken(),
+			ExpiresAt:   time.Now().Add(ttl),
+		},
+	}
+
+	m.sessions[string(hashSessionId(id))] = session
+	return session.GetSessionResult, id, nil
+}
+
+func (m *MemoryStore) GetSession(ctx context.Context, id string) (GetSessionResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[string(hashSessionId(id))]
+
+	if !ok || !session.ExpiresAt.After(time.Now()) {
+		return GetSessionResult{}, ErrSessionNotFound
+	}
+
+	user, ok := m.users[session.UserId]
+
+	if !ok || (user.ExpiresAt != nil && !user.ExpiresAt.After(time.Now())) {
+		return GetSessionResult{}, ErrSessionNotFound
+	}
+
+	out := session.GetSessionResult
+	out.Permissions = user.Permissions
+
+	return out, nil
+}
+
+func (m *MemoryStore) DeleteSession(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sessions, string(hashSessionId(id)))
+	return nil
+}
+
+func (m *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+// MigrationVersion reports the latest migration, there is no schema to fall
+// behind
+func (m *MemoryStore) MigrationVersion(ctx context.Context) (int64, error) {
+	return migrate.LatestVersion()
+}
+
+// InsertStats is always zero, fingerprints are only added by seeding
+func (m *MemoryStore) InsertStats() InsertStats {
+	return InsertStats{}
+}
+
+func (m *MemoryStore) PoolStats() PoolStats {
+	return PoolStats{}
+}
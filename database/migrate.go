@@ -0,0 +1,323 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/metrics"
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/migrate"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"go.uber.org/zap"
+)
+
+// held while migrating so that two instances starting at once take turns,
+// the value is arbitrary but must not change
+const migrationLockKey = 7103925160946
+
+var ErrNothingToRollBack = errors.New("no migrations have been applied")
+
+// MigrationState is a migration along with when it was applied, if it was
+type MigrationState struct {
+	migrate.Migration
+	AppliedAt *time.Time
+}
+
+// MigrationVersion returns the schema version recorded by goose, or 0 if no
+// migrations have been applied
+func (db *Database) MigrationVersion(ctx context.Context) (int64, error) {
+	defer metrics.ObserveQuery("MigrationVersion", time.Now())
+
+	ctx, cancel := db.withQueryTimeout(ctx)
+	defer cancel()
+
+	return migrationVersion(ctx, db.Conn)
+}
+
+type querier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+}
+
+// 42P01 is undefined_table
+const undefinedTableCode = "42P01"
+
+func migrationVersion(ctx context.Context, conn querier) (int64, error) {
+	rows, err := conn.Query(ctx, "SELECT version_id, is_applied FROM goose_db_version ORDER BY id DESC;")
+
+	if err != nil {
+		return 0, ignoreMissingVersionTable(err)
+	}
+
+	defer rows.Close()
+
+	version, err := currentVersion(rows)
+	return version, ignoreMissingVersionTable(err)
+}
+
+// ignoreMissingVersionTable returns nil if err is from goose_db_version not
+// existing, as in a database goose has never touched. Any other error says
+// nothing about the version, so it is returned as is.
+func ignoreMissingVersionTable(err error) error {
+	var pgErr *pgconn.PgError
+
+	if errors.As(err, &pgErr) && pgErr.Code == undefinedTableCode {
+		return nil
+	}
+
+	return err
+}
+
+// versionRows is the part of pgx.Rows and sql.Rows that currentVersion uses
+type versionRows interface {
+	Next() bool
+	Scan(dest ...interface{}) error
+	Err() error
+}
+
+// currentVersion reads the version_id and is_applied of goose_db_version rows,
+// newest first
+func currentVersion(rows versionRows) (int64, error) {
+	// goose records a down migration as a new row with is_applied false, so the
+	// current version is the newest applied row that was not later rolled back
+	rolledBack := map[int64]bool{}
+
+	for rows.Next() {
+		var version int64
+		var applied bool
+
+		if err := rows.Scan(&version, &applied); err != nil {
+			return 0, err
+		}
+
+		if rolledBack[version] {
+			continue
+		}
+
+		if !applied {
+			rolledBack[version] = true
+			continue
+		}
+
+		return version, nil
+	}
+
+	return 0, rows.Err()
+}
+
+// withMigrationLock runs fn on a single connection holding the migration lock,
+// creating the goose version table first if this is a fresh database
+func (db *Database) withMigrationLock(ctx context.Context, fn func(conn *pgxpool.Conn) error) error {
+	conn, err := db.Conn.Acquire(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1);", migrationLockKey); err != nil {
+		return err
+	}
+
+	// a background context, so the lock is still released if ctx is cancelled
+	defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1);", migrationLockKey)
+
+	// the same table, and the same initial row, that goose creates
+	_, err = conn.Exec(ctx, `
+		CREATE TABLE IF NOT EXISTS goose_db_version (
+			id SERIAL PRIMARY KEY,
+			version_id BIGINT NOT NULL,
+			is_applied BOOLEAN NOT NULL,
+			tstamp TIMESTAMP NULL DEFAULT now()
+		);
+		INSERT INTO goose_db_version (version_id, is_applied)
+			SELECT 0, true WHERE NOT EXISTS (SELECT 1 FROM goose_db_version);`)
+
+	if err != nil {
+		return fmt.Errorf("creating goose_db_version: %w", err)
+	}
+
+	return fn(conn)
+}
+
+// runMigration applies or rolls back a single migration in a transaction,
+// recording it in the version table the way goose does
+func runMigration(ctx context.Context, conn *pgxpool.Conn, migration migrate.Migration, up bool) error {
+	statements, err := migration.Statements(up)
+
+	if err != nil {
+		return err
+	}
+
+	tx, err := conn.Begin(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback(ctx)
+
+	for _, statement := range statements {
+		if _, err := tx.Exec(ctx, statement); err != nil {
+			return fmt.Errorf("%s: %w", migration.File, err)
+		}
+	}
+
+	if up {
+		_, err = tx.Exec(ctx, "INSERT INTO goose_db_version (version_id, is_applied) VALUES ($1, true);", migration.Version)
+	} else {
+		_, err = tx.Exec(ctx, "DELETE FROM goose_db_version WHERE version_id = $1;", migration.Version)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// MigrateUp applies every embedded migration newer than the current version,
+// oldest first, returning the ones that were applied
+func (db *Database) MigrateUp(ctx context.Context) ([]migrate.Migration, error) {
+	migrations, err := migrate.List(migrate.Postgres)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var applied []migrate.Migration
+
+	err = db.withMigrationLock(ctx, func(conn *pgxpool.Conn) error {
+		// read under the lock, another instance may have just migrated
+		version, err := migrationVersion(ctx, conn)
+
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range migrations {
+			if migration.Version <= version {
+				continue
+			}
+
+			if err := runMigration(ctx, conn, migration, true); err != nil {
+				return err
+			}
+
+			db.log.Info("applied migration", zap.Int64("version", migration.Version), zap.String("name", migration.Name))
+			applied = append(applied, migration)
+		}
+
+		return nil
+	})
+
+	return applied, err
+}
+
+// MigrateDown rolls back the most recently applied migration, returning it
+func (db *Database) MigrateDown(ctx context.Context) (migrate.Migration, error) {
+	migrations, err := migrate.List(migrate.Postgres)
+
+	if err != nil {
+		return migrate.Migration{}, err
+	}
+
+	var rolledBack migrate.Migration
+
+	err = db.withMigrationLock(ctx, func(conn *pgxpool.Conn) error {
+		version, err := migrationVersion(ctx, conn)
+
+		if err != nil {
+			return err
+		}
+
+		if version == 0 {
+			return ErrNothingToRollBack
+		}
+
+		for _, migration := range migrations {
+			if migration.Version != version {
+				continue
+			}
+
+			if err := runMigration(ctx, conn, migration, false); err != nil {
+				return err
+			}
+
+			db.log.Info("rolled back migration", zap.Int64("version", migration.Version), zap.String("name", migration.Name))
+			rolledBack = migration
+			return nil
+		}
+
+		return fmt.Errorf("version %d is not one of the embedded migrations", version)
+	})
+
+	return rolledBack, err
+}
+
+// MigrationStatus returns every embedded migration, oldest first, with the
+// time it was applied at
+func (db *Database) MigrationStatus(ctx context.Context) ([]MigrationState, error) {
+	migrations, err := migrate.List(migrate.Postgres)
+
+	if err != nil {
+		return nil, err
+	}
+
+	applied := map[int64]time.Time{}
+
+	err = db.withMigrationLock(ctx, func(conn *pgxpool.Conn) error {
+		rows, err := conn.Query(ctx, "SELECT version_id, is_applied, tstamp FROM goose_db_version ORDER BY id;")
+
+		if err != nil {
+			return err
+		}
+
+		defer rows.Close()
+
+		for rows.Next() {
+			var version int64
+			var isApplied bool
+			var at time.Time
+
+			if err := rows.Scan(&version, &isApplied, &at); err != nil {
+				return err
+			}
+
+			// rows are read oldest first, so a later roll back wins
+			if isApplied {
+				applied[version] = at
+			} else {
+				delete(applied, version)
+			}
+		}
+
+		return rows.Err()
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]MigrationState, 0, len(migrations))
+
+	for _, migration := range migrations {
+		state := MigrationState{Migration: migration}
+
+		if at, ok := applied[migration.Version]; ok {
+			state.AppliedAt = &at
+		}
+
+		out = append(out, state)
+	}
+
+	return out, nil
+}
+
+// Ping checks that a connection to the database can be acquired and used
+func (db *Database) Ping(ctx context.Context) error {
+	return db.Conn.Ping(ctx)
+}
@@ -3,27 +3,62 @@ package database
 import (
 	"context"
 	"errors"
+	"fmt"
+	"strings"
+	"time"
 
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/common"
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/metrics"
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
+	"go.uber.org/zap"
 )
 
 const defaultToken = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
 
 var ErrDefaultToken = errors.New("change the default admin token")
+var ErrUserNotFound = errors.New("user not found")
+var ErrTokenExpired = errors.New("token has expired")
+var ErrCertSubjectTaken = errors.New("certificate subject is already mapped to a user")
+var ErrAdminExists = errors.New("an admin user already exists")
+var ErrFingerprintNotFound = errors.New("fingerprint not found")
+
+// selects the columns of a GetFingerprintResult, in the order they are scanned
+const selectFingerprints = "SELECT f.id, f.fingerprint, s.proxy_ip, f.created_at FROM fingerprints f JOIN sources s ON s.id = f.source_id"
+
+// AddFingerprint stores a fingerprint fetched through the proxy at ip, adding
+// the proxy to sources the first time it is seen
+func (db *Database) AddFingerprint(ctx context.Context, fp string, ip string) (GetFingerprintResult, error) {
+	defer metrics.ObserveQuery("AddFingerprint", time.Now())
+
+	ctx, cancel := db.withQueryTimeout(ctx)
+	defer cancel()
+
+	out := GetFingerprintResult{Fingerprint: fp, ProxyIP: ip}
+
+	// the no-op update makes RETURNING give the id of an existing source too
+	err := db.Conn.QueryRow(ctx, `
+		WITH source AS (
+			INSERT INTO sources (proxy_ip) VALUES ($2)
+			ON CONFLICT (proxy_ip) DO UPDATE SET proxy_ip = EXCLUDED.proxy_ip
+			RETURNING id
+		)
+		INSERT INTO fingerprints (fingerprint, source_id) SELECT $1, id FROM source
+		RETURNING id, created_at;`,
+		fp, ip,
+	).Scan(&out.ID, &out.CreatedAt)
 
-func (db *Database) AddFingerprint(fp string, ip string) (bool, error) {
-	result, err := db.Conn.Exec(context.Background(), "INSERT INTO fingerprints (fingerprint, proxy_ip) VALUES ($1, $2);", fp, ip)
+	return out, err
+}
 
-	if err != nil {
-		return false, err
-	}
+func (db *Database) CountFingerprints(ctx context.Context) (uint64, error) {
+	defer metrics.ObserveQuery("CountFingerprints", time.Now())
 
-	return result.RowsAffected() > 0, err
-}
+	ctx, cancel := db.withQueryTimeout(ctx)
+	defer cancel()
 
-func (db *Database) CountFingerprints() (uint64, error) {
 	var out uint64
-	err := db.Conn.QueryRow(context.Background(), "SELECT COUNT(*) FROM fingerprints;").Scan(&out)
+	err := db.Conn.QueryRow(ctx, "SELECT COUNT(*) FROM fingerprints;").Scan(&out)
 
 	if err != nil {
 		return 0, err
@@ -32,37 +67,131 @@ func (db *Database) CountFingerprints() (uint64, error) {
 	return out, nil
 }
 
-func (db *Database) GetRandomFingerprint() (GetFingerprintResult, error) {
+// CountFingerprintsByPeriod counts the fingerprints inserted since the given time,
+// grouped by the period they were inserted in ("hour" or "day", in UTC). Periods
+// with nothing inserted are omitted.
+func (db *Database) CountFingerprintsByPeriod(ctx context.Context, since time.Time, period string) ([]InsertBucket, error) {
+	defer metrics.ObserveQuery("CountFingerprintsByPeriod", time.Now())
+
+	ctx, cancel := db.withQueryTimeout(ctx)
+	defer cancel()
+
+	var out []InsertBucket
+
+	rows, err := db.Conn.Query(
+		ctx,
+		"SELECT date_trunc($1, created_at AT TIME ZONE 'UTC') AS bucket, COUNT(*) FROM fingerprints WHERE created_at >= $2 GROUP BY bucket ORDER BY bucket",
+		period, since,
+	)
+
+	if err != nil {
+		return out, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var data InsertBucket
+
+		if err := rows.Scan(&data.Start, &data.Count); err != nil {
+			return out, err
+		}
+
+		// timestamps without a zone are scanned as UTC already, this just makes it explicit
+		data.Start = data.Start.UTC()
+		out = append(out, data)
+	}
+
+	return out, rows.Err()
+}
+
+func (db *Database) GetRandomFingerprint(ctx context.Context) (GetFingerprintResult, error) {
+	defer metrics.ObserveQuery("GetRandomFingerprint", time.Now())
+
+	ctx, cancel := db.withQueryTimeout(ctx)
+	defer cancel()
+
 	var out GetFingerprintResult
 
-	err := db.Conn.QueryRow(context.Background(), "SELECT id, fingerprint, proxy_ip FROM fingerprints ORDER BY random() LIMIT 1").
-		Scan(&out.ID, &out.Fingerprint, &out.ProxyIP)
+	err := db.Conn.QueryRow(ctx, selectFingerprints+" ORDER BY random() LIMIT 1").
+		Scan(&out.ID, &out.Fingerprint, &out.ProxyIP, &out.CreatedAt)
+
+	if err != nil && errors.Is(err, pgx.ErrNoRows) {
+		return out, ErrFingerprintNotFound
+	}
 
 	return out, err
 }
 
-func (db *Database) GetSpecificFingerprint(id uint64) (GetFingerprintResult, error) {
+func (db *Database) GetSpecificFingerprint(ctx context.Context, id uint64) (GetFingerprintResult, error) {
+	defer metrics.ObserveQuery("GetSpecificFingerprint", time.Now())
+
+	ctx, cancel := db.withQueryTimeout(ctx)
+	defer cancel()
+
 	var out GetFingerprintResult
 
-	err := db.Conn.QueryRow(context.Background(), "SELECT id, fingerprint, proxy_ip FROM fingerprints WHERE id = $1 LIMIT 1;", id).
-		Scan(&out.ID, &out.Fingerprint, &out.ProxyIP)
+	err := db.Conn.QueryRow(ctx, selectFingerprints+" WHERE f.id = $1 LIMIT 1;", id).
+		Scan(&out.ID, &out.Fingerprint, &out.ProxyIP, &out.CreatedAt)
+
+	if err != nil && errors.Is(err, pgx.ErrNoRows) {
+		return out, ErrFingerprintNotFound
+	}
 
 	return out, err
 }
 
-func (db *Database) GetAllFingerprints() ([]string, error) {
-	var out []string
+// ListFingerprints returns a page of fingerprints, newest first. Only the
+// conditions that are set are added to the query, so that every combination
+// is answered from an index.
+func (db *Database) ListFingerprints(ctx context.Context, options ListFingerprintsOptions) ([]GetFingerprintResult, error) {
+	defer metrics.ObserveQuery("ListFingerprints", time.Now())
+
+	ctx, cancel := db.withQueryTimeout(ctx)
+	defer cancel()
+
+	var out []GetFingerprintResult
 
-	rows, err := db.Conn.Query(context.Background(), "SELECT fingerprint FROM fingerprints ORDER BY id DESC")
+	var conditions []string
+	var args []interface{}
+
+	if options.BeforeID != nil {
+		args = append(args, *options.BeforeID)
+		conditions = append(conditions, fmt.Sprintf("f.id < $%d", len(args)))
+	}
+
+	if options.SinceID != nil {
+		args = append(args, *options.SinceID)
+		conditions = append(conditions, fmt.Sprintf("f.id > $%d", len(args)))
+	}
+
+	if options.ProxyIP != nil {
+		args = append(args, *options.ProxyIP)
+		// matched on source_id so that the (source_id, id) index is used
+		conditions = append(conditions, fmt.Sprintf("f.source_id = (SELECT id FROM sources WHERE proxy_ip = $%d)", len(args)))
+	}
+
+	query := selectFingerprints
+
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	args = append(args, options.Limit)
+	query += fmt.Sprintf(" ORDER BY f.id DESC LIMIT $%d", len(args))
+
+	rows, err := db.Conn.Query(ctx, query, args...)
 
 	if err != nil {
 		return out, err
 	}
 
+	defer rows.Close()
+
 	for rows.Next() {
-		var data string
+		var data GetFingerprintResult
 
-		err = rows.Scan(&data)
+		err = rows.Scan(&data.ID, &data.Fingerprint, &data.ProxyIP, &data.CreatedAt)
 
 		if err != nil {
 			return out, err
@@ -78,46 +207,134 @@ func (db *Database) GetAllFingerprints() ([]string, error) {
 	return out, err
 }
 
-func (db *Database) CheckAuthValid(token string) (GetAuthResult, error) {
-	var out GetAuthResult
+// StreamFingerprints calls fn with every fingerprint, newest first, as the rows
+// arrive from the database rather than loading them all into memory. Returning
+// an error from fn, or cancelling ctx, stops the query.
+func (db *Database) StreamFingerprints(ctx context.Context, fn func(GetFingerprintResult) error) error {
+	rows, err := db.Conn.Query(ctx, selectFingerprints+" ORDER BY f.id DESC")
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var data GetFingerprintResult
+
+		if err := rows.Scan(&data.ID, &data.Fingerprint, &data.ProxyIP, &data.CreatedAt); err != nil {
+			return err
+		}
+
+		if err := fn(data); err != nil {
+			return err
+		}
+	}
 
-	if len(token) != 32 {
+	return rows.Err()
+}
+
+func (db *Database) CheckAuthValid(ctx context.Context, token string) (GetAuthResult, error) {
+	defer metrics.ObserveQuery("CheckAuthValid", time.Now())
+
+	ctx, cancel := db.withQueryTimeout(ctx)
+	defer cancel()
+
+	if len(token) != common.TokenLength {
 		return GetAuthResult{Valid: false}, nil
 	}
 
-	err := db.Conn.QueryRow(context.Background(), "SELECT user_id, permissions FROM auth WHERE token = $1 LIMIT 1", token).
-		Scan(&out.UserId, &out.Permissions)
+	rows, err := db.Conn.Query(ctx, "SELECT user_id, permissions, token_salt, token_hash, expires_at FROM auth WHERE token_prefix = $1", tokenPrefix(token))
+
+	if err != nil {
+		return GetAuthResult{}, err
+	}
+
+	defer rows.Close()
+
+	// prefixes are not unique, so every candidate has to be checked
+	for rows.Next() {
+		var out GetAuthResult
+		var salt, hash []byte
+		var expiresAt *time.Time
+
+		if err := rows.Scan(&out.UserId, &out.Permissions, &salt, &hash, &expiresAt); err != nil {
+			return GetAuthResult{}, err
+		}
+
+		if !verifyToken(token, salt, hash) {
+			continue
+		}
+
+		if out.UserId == 0 && token == defaultToken {
+			return GetAuthResult{}, ErrDefaultToken
+		}
+
+		if expiresAt != nil && !time.Now().Before(*expiresAt) {
+			return GetAuthResult{}, ErrTokenExpired
+		}
+
+		out.Valid = true
+		return out, nil
+	}
+
+	if rows.Err() != nil {
+		return GetAuthResult{}, rows.Err()
+	}
+
+	return GetAuthResult{Valid: false, Permissions: 0}, nil
+}
+
+// CheckCertAuth finds the user mapped to the subject of a verified client
+// certificate, the certificate taking the place of the token
+func (db *Database) CheckCertAuth(ctx context.Context, subject string) (GetAuthResult, error) {
+	defer metrics.ObserveQuery("CheckCertAuth", time.Now())
+
+	ctx, cancel := db.withQueryTimeout(ctx)
+	defer cancel()
+
+	var out GetAuthResult
+	var expiresAt *time.Time
+
+	err := db.Conn.QueryRow(ctx, "SELECT user_id, permissions, expires_at FROM auth WHERE cert_subject = $1", subject).
+		Scan(&out.UserId, &out.Permissions, &expiresAt)
 
 	if err != nil && errors.Is(err, pgx.ErrNoRows) {
-		return GetAuthResult{Valid: false, Permissions: 0}, nil
+		return GetAuthResult{Valid: false}, nil
 	}
 
 	if err != nil {
 		return GetAuthResult{}, err
 	}
 
-	out.Valid = true
-
-	if out.UserId == 0 && token == defaultToken {
-		return GetAuthResult{}, ErrDefaultToken
+	if expiresAt != nil && !time.Now().Before(*expiresAt) {
+		return GetAuthResult{}, ErrTokenExpired
 	}
 
+	out.Valid = true
 	return out, nil
 }
 
-func (db *Database) GetAllUsers() ([]GetUserResult, error) {
+func (db *Database) GetAllUsers(ctx context.Context) ([]GetUserResult, error) {
+	defer metrics.ObserveQuery("GetAllUsers", time.Now())
+
+	ctx, cancel := db.withQueryTimeout(ctx)
+	defer cancel()
+
 	var out []GetUserResult
 
-	rows, err := db.Conn.Query(context.Background(), "SELECT user_id, permissions, token FROM auth")
+	rows, err := db.Conn.Query(ctx, "SELECT user_id, permissions, token_prefix, label, created_at, expires_at, last_used_at, cert_subject FROM auth ORDER BY user_id")
 
 	if err != nil {
 		return out, err
 	}
 
+	defer rows.Close()
+
 	for rows.Next() {
 		var data GetUserResult
 
-		err = rows.Scan(&data.UserId, &data.Permissions, &data.Token)
+		err = rows.Scan(&data.UserId, &data.Permissions, &data.TokenPrefix, &data.Label, &data.CreatedAt, &data.ExpiresAt, &data.LastUsedAt, &data.CertSubject)
 
 		if err != nil {
 			return out, err
@@ -132,3 +349,207 @@ func (db *Database) GetAllUsers() ([]GetUserResult, error) {
 
 	return out, err
 }
+
+func (db *Database) GetUser(ctx context.Context, userId uint64) (GetUserResult, error) {
+	defer metrics.ObserveQuery("GetUser", time.Now())
+
+	ctx, cancel := db.withQueryTimeout(ctx)
+	defer cancel()
+
+	var data GetUserResult
+
+	err := db.Conn.QueryRow(ctx, "SELECT user_id, permissions, token_prefix, label, created_at, expires_at, last_used_at, cert_subject FROM auth WHERE user_id = $1;", userId).
+		Scan(&data.UserId, &data.Permissions, &data.TokenPrefix, &data.Label, &data.CreatedAt, &data.ExpiresAt, &data.LastUsedAt, &data.CertSubject)
+
+	if err != nil && errors.Is(err, pgx.ErrNoRows) {
+		return data, ErrUserNotFound
+	}
+
+	return data, err
+}
+
+// HasAdmin reports whether any user holds the admin permission
+func (db *Database) HasAdmin(ctx context.Context) (bool, error) {
+	defer metrics.ObserveQuery("HasAdmin", time.Now())
+
+	ctx, cancel := db.withQueryTimeout(ctx)
+	defer cancel()
+
+	var out bool
+
+	err := db.Conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM auth WHERE permissions & $1 != 0);", common.PermissionAdmin).
+		Scan(&out)
+
+	return out, err
+}
+
+// BootstrapAdmin creates the first admin user, returning its token. It fails
+// with ErrAdminExists if an admin is already present, so it is safe to run
+// more than once.
+func (db *Database) BootstrapAdmin(ctx context.Context) (GetUserResult, string, error) {
+	defer metrics.ObserveQuery("BootstrapAdmin", time.Now())
+
+	ctx, cancel := db.withQueryTimeout(ctx)
+	defer cancel()
+
+	token := common.GenerateToken()
+	hashed, err := newHashedToken(token)
+
+	if err != nil {
+		return GetUserResult{}, "", err
+	}
+
+	tx, err := db.Conn.Begin(ctx)
+
+	if err != nil {
+		return GetUserResult{}, "", err
+	}
+
+	defer tx.Rollback(ctx)
+
+	// stops two bootstraps running at once from both creating an admin
+	if _, err := tx.Exec(ctx, "LOCK TABLE auth IN EXCLUSIVE MODE;"); err != nil {
+		return GetUserResult{}, "", err
+	}
+
+	var exists bool
+
+	err = tx.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM auth WHERE permissions & $1 != 0);", common.PermissionAdmin).
+		Scan(&exists)
+
+	if err != nil {
+		return GetUserResult{}, "", err
+	}
+
+	if exists {
+		return GetUserResult{}, "", ErrAdminExists
+	}
+
+	out := GetUserResult{
+		Permissions: common.PermissionAll,
+		TokenPrefix: hashed.Prefix,
+		Label:       "bootstrap",
+	}
+
+	err = tx.QueryRow(
+		ctx,
+		"INSERT INTO auth (permissions, token_prefix, token_salt, token_hash, label) VALUES ($1, $2, $3, $4, $5) RETURNING user_id, created_at;",
+		out.Permissions, hashed.Prefix, hashed.Salt, hashed.Hash, out.Label,
+	).Scan(&out.UserId, &out.CreatedAt)
+
+	if err != nil {
+		return GetUserResult{}, "", err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return GetUserResult{}, "", err
+	}
+
+	return out, token, nil
+}
+
+// CreateUser adds a new user with the given permissions, returning the user
+// along with the token that was generated for it. The token is not stored, so
+// this is the only time it can be read.
+func (db *Database) CreateUser(ctx context.Context, options CreateUserOptions) (GetUserResult, string, error) {
+	defer metrics.ObserveQuery("CreateUser", time.Now())
+
+	ctx, cancel := db.withQueryTimeout(ctx)
+	defer cancel()
+
+	token := common.GenerateToken()
+	hashed, err := newHashedToken(token)
+
+	if err != nil {
+		return GetUserResult{}, "", err
+	}
+
+	out := GetUserResult{
+		Permissions: options.Permissions,
+		TokenPrefix: hashed.Prefix,
+		Label:       options.Label,
+		ExpiresAt:   options.ExpiresAt,
+		CertSubject: options.CertSubject,
+	}
+
+	err = db.Conn.QueryRow(
+		ctx,
+		"INSERT INTO auth (permissions, token_prefix, token_salt, token_hash, label, expires_at, cert_subject) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING user_id, created_at;",
+		options.Permissions, hashed.Prefix, hashed.Salt, hashed.Hash, options.Label, options.ExpiresAt, options.CertSubject,
+	).Scan(&out.UserId, &out.CreatedAt)
+
+	var pgErr *pgconn.PgError
+
+	// 23505 is unique_violation
+	if err != nil && errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "auth_cert_subject_key" {
+		return GetUserResult{}, "", ErrCertSubjectTaken
+	}
+
+	if err != nil {
+		return GetUserResult{}, "", err
+	}
+
+	return out, token, nil
+}
+
+// RotateToken replaces the token of the given user with a newly generated one,
+// which is returned alongside the user
+func (db *Database) RotateToken(ctx context.Context, userId uint64) (GetUserResult, string, error) {
+	defer metrics.ObserveQuery("RotateToken", time.Now())
+
+	ctx, cancel := db.withQueryTimeout(ctx)
+	defer cancel()
+
+	token := common.GenerateToken()
+	hashed, err := newHashedToken(token)
+
+	if err != nil {
+		return GetUserResult{}, "", err
+	}
+
+	out := GetUserResult{
+		UserId:      userId,
+		TokenPrefix: hashed.Prefix,
+	}
+
+	err = db.Conn.QueryRow(
+		ctx,
+		"UPDATE auth SET token_prefix = $2, token_salt = $3, token_hash = $4 WHERE user_id = $1 RETURNING permissions, label, created_at, expires_at, last_used_at, cert_subject;",
+		userId, hashed.Prefix, hashed.Salt, hashed.Hash,
+	).Scan(&out.Permissions, &out.Label, &out.CreatedAt, &out.ExpiresAt, &out.LastUsedAt, &out.CertSubject)
+
+	if err != nil && errors.Is(err, pgx.ErrNoRows) {
+		return GetUserResult{}, "", ErrUserNotFound
+	}
+
+	if err != nil {
+		return GetUserResult{}, "", err
+	}
+
+	// console sessions were started with the old token, so they go with it
+	if _, err := db.Conn.Exec(ctx, "DELETE FROM console_sessions WHERE user_id = $1;", userId); err != nil {
+		db.log.Warn("could not remove console sessions", zap.Uint64("user", userId), zap.Error(err))
+	}
+
+	return out, token, nil
+}
+
+// RevokeUser deletes the given user, invalidating its token
+func (db *Database) RevokeUser(ctx context.Context, userId uint64) error {
+	defer metrics.ObserveQuery("RevokeUser", time.Now())
+
+	ctx, cancel := db.withQueryTimeout(ctx)
+	defer cancel()
+
+	result, err := db.Conn.Exec(ctx, "DELETE FROM auth WHERE user_id = $1;", userId)
+
+	if err != nil {
+		return err
+	}
+
+	if result.RowsAffected() == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/metrics"
+	"go.uber.org/zap"
+)
+
+type RateLimitCounts struct {
+	// requests made in the current window, including this one
+	Window uint64
+	// requests made in the current day, including this one
+	Day uint64
+}
+
+// HitRateLimit counts a request against both the window starting at windowStart
+// and the day starting at dayStart, returning the updated counts. Counters live
+// in the database so that limits survive restarts and are shared between instances.
+func (db *Database) HitRateLimit(ctx context.Context, userId uint64, windowStart time.Time, dayStart time.Time) (RateLimitCounts, error) {
+	defer metrics.ObserveQuery("HitRateLimit", time.Now())
+
+	ctx, cancel := db.withQueryTimeout(ctx)
+	defer cancel()
+
+	var out RateLimitCounts
+
+	err := db.Conn.QueryRow(ctx, `
+		WITH w AS (
+			INSERT INTO rate_limit_counters (user_id, bucket, window_start, count) VALUES ($1, 'window', $2, 1)
+			ON CONFLICT (user_id, bucket, window_start) DO UPDATE SET count = rate_limit_counters.count + 1
+			RETURNING count
+		), d AS (
+			INSERT INTO rate_limit_counters (user_id, bucket, window_start, count) VALUES ($1, 'day', $3, 1)
+			ON CONFLICT (user_id, bucket, window_start) DO UPDATE SET count = rate_limit_counters.count + 1
+			RETURNING count
+		)
+		SELECT w.count, d.count FROM w, d;`,
+		userId, windowStart, dayStart,
+	).Scan(&out.Window, &out.Day)
+
+	if err != nil {
+		return RateLimitCounts{}, err
+	}
+
+	// the first request of a window means the previous ones are finished with
+	if out.Window == 1 {
+		_, err = db.Conn.Exec(
+			ctx,
+			"DELETE FROM rate_limit_counters WHERE user_id = $1 AND ((bucket = 'window' AND window_start < $2) OR (bucket = 'day' AND window_start < $3));",
+			userId, windowStart, dayStart,
+		)
+
+		if err != nil {
+			db.log.Warn("could not remove old rate limit counters", zap.Uint64("user", userId), zap.Error(err))
+		}
+	}
+
+	return out, nil
+}
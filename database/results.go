@@ -1,11 +1,17 @@
 package database
 
-import "github.com/getaddrinfo/proxy-fingerprint-scraper/common"
+import (
+	"time"
+
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/common"
+)
 
 type GetFingerprintResult struct {
 	ID          uint64
 	Fingerprint string
 	ProxyIP     string
+	// nil for fingerprints fetched before the time was recorded
+	CreatedAt *time.Time
 }
 
 type GetAuthResult struct {
@@ -17,5 +23,75 @@ type GetAuthResult struct {
 type GetUserResult struct {
 	UserId      uint64
 	Permissions common.Permission
-	Token       string
+	TokenPrefix string
+	Label       string
+	CreatedAt   time.Time
+	ExpiresAt   *time.Time
+	LastUsedAt  *time.Time
+	CertSubject *string
+}
+
+type CreateUserOptions struct {
+	Permissions common.Permission
+	Label       string
+	ExpiresAt   *time.Time
+	// the subject of a client certificate that also authenticates as the user
+	CertSubject *string
+}
+
+type AuditLogEntry struct {
+	ID         uint64
+	CreatedAt  time.Time
+	RequestID  string
+	UserId     uint64
+	Method     string
+	Route      string
+	Status     int
+	Duration   time.Duration
+	RemoteAddr string
+}
+
+type AuditLogFilter struct {
+	Since  *time.Time
+	Until  *time.Time
+	UserId *uint64
+	Limit  uint64
+}
+
+type GetSessionResult struct {
+	UserId      uint64
+	Permissions common.Permission
+	CsrfToken   string
+	ExpiresAt   time.Time
+}
+
+type ListFingerprintsOptions struct {
+	// maximum number of rows to return
+	Limit uint64
+	// only return rows with an id lower than this
+	BeforeID *uint64
+	// only return rows with an id higher than this
+	SinceID *uint64
+	// only return rows fetched through this proxy
+	ProxyIP *string
+}
+
+type InsertStats struct {
+	Inserted uint64
+	Failed   uint64
+}
+
+type PoolStats struct {
+	TotalConns    int32
+	IdleConns     int32
+	AcquiredConns int32
+	MaxConns      int32
+	AcquireCount  int64
+	// total time spent waiting for a connection
+	AcquireWait time.Duration
+}
+
+type InsertBucket struct {
+	Start time.Time
+	Count uint64
 }
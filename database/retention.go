@@ -0,0 +1,103 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/metrics"
+)
+
+// RetentionPolicy decides which fingerprints are kept. A zero field is no
+// limit, so the zero policy keeps everything.
+type RetentionPolicy struct {
+	// fingerprints fetched longer ago than this are deleted
+	MaxAge time.Duration
+	// only this many of the newest fingerprints are kept
+	MaxRows uint64
+}
+
+// Enabled is false if the policy keeps everything
+func (p RetentionPolicy) Enabled() bool {
+	return p.MaxAge > 0 || p.MaxRows > 0
+}
+
+// RetentionReport describes the fingerprints a policy would delete. They are
+// always the oldest, every id up to and including MaxID.
+type RetentionReport struct {
+	Count  uint64
+	MaxID  uint64
+	Oldest *time.Time
+	Newest *time.Time
+}
+
+// CheckRetention reports what the policy would delete right now, without
+// deleting anything
+func (db *Database) CheckRetention(ctx context.Context, policy RetentionPolicy) (RetentionReport, error) {
+	defer metrics.ObserveQuery("CheckRetention", time.Now())
+
+	ctx, cancel := db.withQueryTimeout(ctx)
+	defer cancel()
+
+	var out RetentionReport
+
+	var limits []string
+	var args []interface{}
+
+	if policy.MaxAge > 0 {
+		args = append(args, time.Now().Add(-policy.MaxAge))
+		// fingerprints without a time were fetched before every one with a time
+		limits = append(limits, fmt.Sprintf("(SELECT MAX(id) FROM fingerprints WHERE created_at IS NULL OR created_at < $%d)", len(args)))
+	}
+
+	if policy.MaxRows > 0 {
+		args = append(args, policy.MaxRows)
+		limits = append(limits, fmt.Sprintf("(SELECT id FROM fingerprints ORDER BY id DESC OFFSET $%d LIMIT 1)", len(args)))
+	}
+
+	if len(limits) == 0 {
+		return out, nil
+	}
+
+	// GREATEST skips the limits that match nothing, and is null if they all do
+	var maxID *uint64
+
+	err := db.Conn.QueryRow(
+		ctx,
+		fmt.Sprintf("SELECT COUNT(*), MAX(id), MIN(created_at), MAX(created_at) FROM fingerprints WHERE id <= GREATEST(%s);", strings.Join(limits, ", ")),
+		args...,
+	).Scan(&out.Count, &maxID, &out.Oldest, &out.Newest)
+
+	if err != nil {
+		return RetentionReport{}, err
+	}
+
+	if maxID != nil {
+		out.MaxID = *maxID
+	}
+
+	return out, nil
+}
+
+// DeleteFingerprintsUpTo deletes at most limit of the oldest fingerprints with
+// an id no greater than maxID, returning how many were deleted. Deleting in
+// small batches keeps each statement, and the locks it takes, short.
+func (db *Database) DeleteFingerprintsUpTo(ctx context.Context, maxID uint64, limit uint64) (uint64, error) {
+	defer metrics.ObserveQuery("DeleteFingerprintsUpTo", time.Now())
+
+	ctx, cancel := db.withQueryTimeout(ctx)
+	defer cancel()
+
+	result, err := db.Conn.Exec(
+		ctx,
+		"DELETE FROM fingerprints WHERE id IN (SELECT id FROM fingerprints WHERE id <= $1 ORDER BY id LIMIT $2);",
+		maxID, limit,
+	)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(result.RowsAffected()), nil
+}
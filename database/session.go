@@ -0,0 +1,91 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"time"
+
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/common"
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/metrics"
+	"github.com/jackc/pgx/v4"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// only the hash of a session id is stored, so a leaked table cannot be used to log in
+func hashSessionId(id string) []byte {
+	sum := sha256.Sum256([]byte(id))
+	return sum[:]
+}
+
+// CreateSession starts a console session for the user, returning the session
+// id to hand to the browser
+func (db *Database) CreateSession(ctx context.Context, userId uint64, ttl time.Duration) (GetSessionResult, string, error) {
+	defer metrics.ObserveQuery("CreateSession", time.Now())
+
+	ctx, cancel := db.withQueryTimeout(ctx)
+	defer cancel()
+
+	id := common.GenerateToken()
+
+	out := GetSessionResult{
+		UserId:    userId,
+		CsrfToken: common.GenerateToken(),
+		ExpiresAt: time.Now().Add(ttl),
+	}
+
+	// expired sessions are cleaned up whenever someone logs in, which is often enough
+	// to stop the table growing
+	if _, err := db.Conn.Exec(ctx, "DELETE FROM console_sessions WHERE expires_at < now();"); err != nil {
+		return GetSessionResult{}, "", err
+	}
+
+	err := db.Conn.QueryRow(
+		ctx,
+		"INSERT INTO console_sessions (id_hash, user_id, csrf_token, expires_at) VALUES ($1, $2, $3, $4) RETURNING (SELECT permissions FROM auth WHERE user_id = $2);",
+		hashSessionId(id), userId, out.CsrfToken, out.ExpiresAt,
+	).Scan(&out.Permissions)
+
+	if err != nil {
+		return GetSessionResult{}, "", err
+	}
+
+	return out, id, nil
+}
+
+// GetSession returns the session along with the current permissions of its user,
+// failing with ErrSessionNotFound if it does not exist or either it or the
+// user's token has expired
+func (db *Database) GetSession(ctx context.Context, id string) (GetSessionResult, error) {
+	defer metrics.ObserveQuery("GetSession", time.Now())
+
+	ctx, cancel := db.withQueryTimeout(ctx)
+	defer cancel()
+
+	var out GetSessionResult
+
+	err := db.Conn.QueryRow(
+		ctx,
+		`SELECT s.user_id, a.permissions, s.csrf_token, s.expires_at FROM console_sessions s
+		JOIN auth a ON a.user_id = s.user_id
+		WHERE s.id_hash = $1 AND s.expires_at > now() AND (a.expires_at IS NULL OR a.expires_at > now())`,
+		hashSessionId(id),
+	).Scan(&out.UserId, &out.Permissions, &out.CsrfToken, &out.ExpiresAt)
+
+	if err != nil && errors.Is(err, pgx.ErrNoRows) {
+		return GetSessionResult{}, ErrSessionNotFound
+	}
+
+	return out, err
+}
+
+func (db *Database) DeleteSession(ctx context.Context, id string) error {
+	defer metrics.ObserveQuery("DeleteSession", time.Now())
+
+	ctx, cancel := db.withQueryTimeout(ctx)
+	defer cancel()
+
+	_, err := db.Conn.Exec(ctx, "DELETE FROM console_sessions WHERE id_hash = $1;", hashSessionId(id))
+	return err
+}
@@ -0,0 +1,181 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/common"
+	"go.uber.org/zap"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// how sqlite is opened: foreign keys enforced, writers waiting for each other
+// rather than failing, readers not blocked by writers, transactions taking the
+// write lock up front, and times written in a format that sorts as text
+const sqliteParams = "_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(wal)&_txlock=immediate&_time_format=sqlite"
+
+// the layout times are written in with _time_format=sqlite
+const sqliteTimeLayout = "2006-01-02 15:04:05.999999999-07:00"
+
+// SQLiteStore implements Store over a single sqlite file, for running on one
+// machine without a postgres server
+type SQLiteStore struct {
+	Conn *sql.DB
+	ctx  context.Context
+	log  *zap.Logger
+
+	queryTimeout time.Duration
+
+	lastUsed *lastUsedFlusher
+
+	inserts insertCounts
+}
+
+// NewSQLiteStore opens the file named by a sqlite:// url, creating it if it
+// does not exist. sqlite://scraper.db is relative to the working directory,
+// sqlite:///var/lib/scraper/scraper.db is absolute.
+func NewSQLiteStore(ctx context.Context, options NewDatabaseOptions) (*SQLiteStore, error) {
+	log := zap.L().Named("db")
+
+	dsn := strings.TrimPrefix(options.URL, "sqlite://")
+
+	if strings.Contains(dsn, "?") {
+		dsn += "&" + sqliteParams
+	} else {
+		dsn += "?" + sqliteParams
+	}
+
+	conn, err := sql.Open("sqlite", dsn)
+
+	if err == nil {
+		err = conn.PingContext(ctx)
+	}
+
+	if err != nil {
+		log.Error(err.Error())
+		return nil, err
+	}
+
+	log.Info("opened sqlite database")
+
+	s := &SQLiteStore{
+		Conn:         conn,
+		ctx:          ctx,
+		log:          log,
+		queryTimeout: options.QueryTimeout,
+	}
+
+	if s.queryTimeout <= 0 {
+		s.queryTimeout = DefaultQueryTimeout
+	}
+
+	s.lastUsed = newLastUsedFlusher(log, s.writeLastUsed)
+	go s.lastUsed.run(ctx)
+
+	return s, nil
+}
+
+func (s *SQLiteStore) withQueryTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, s.queryTimeout)
+}
+
+// Close writes out any pending last used times, then closes the database. Like
+// Database.Close it blocks until the context given to NewSQLiteStore is done,
+// and must be called after the last request using it has finished.
+func (s *SQLiteStore) Close() {
+	s.lastUsed.close()
+
+	if err := s.Conn.Close(); err != nil {
+		s.log.Warn("could not close", zap.Error(err))
+		return
+	}
+
+	s.log.Info("closed")
+}
+
+// ListenForNewFingerprints stores the results sent on channel until the
+// context given to NewSQLiteStore is done
+func (s *SQLiteStore) ListenForNewFingerprints(channel common.FingerprintResultChannel) {
+	listenForFingerprints(s.ctx, s.log, channel, &s.inserts, s.AddFingerprint)
+}
+
+func (s *SQLiteStore) InsertStats() InsertStats {
+	return s.inserts.stats()
+}
+
+// PoolStats maps what database/sql reports onto the pgx pool statistics, it
+// does not count acquisitions so AcquireCount is always zero
+func (s *SQLiteStore) PoolStats() PoolStats {
+	stat := s.Conn.Stats()
+
+	return PoolStats{
+		TotalConns:    int32(stat.OpenConnections),
+		IdleConns:     int32(stat.Idle),
+		AcquiredConns: int32(stat.InUse),
+		MaxConns:      int32(stat.MaxOpenConnections),
+		AcquireWait:   stat.WaitDuration,
+	}
+}
+
+func (s *SQLiteStore) Ping(ctx context.Context) error {
+	return s.Conn.PingContext(ctx)
+}
+
+// sqliteCode returns the extended result code of a sqlite error, or 0
+func sqliteCode(err error) int {
+	var sqliteErr *sqlite.Error
+
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code()
+	}
+
+	return 0
+}
+
+// isSqliteInterrupt reports whether err is sqlite stopping a statement, which
+// the driver does when the statement's context is done
+func isSqliteInterrupt(err error) bool {
+	return sqliteCode(err) == sqlite3.SQLITE_INTERRUPT
+}
+
+// nullTime scans a nullable timestamp. The driver only parses timestamps
+// itself for columns declared as TIMESTAMP, not for expressions such as MIN.
+type nullTime struct {
+	dest **time.Time
+}
+
+func (t nullTime) Scan(src interface{}) error {
+	switch value := src.(type) {
+	case nil:
+		*t.dest = nil
+	case time.Time:
+		*t.dest = &value
+	case string:
+		parsed, err := time.Parse(sqliteTimeLayout, value)
+
+		if err != nil {
+			return err
+		}
+
+		*t.dest = &parsed
+	default:
+		return fmt.Errorf("cannot scan %T as a timestamp", src)
+	}
+
+	return nil
+}
+
+// utc converts an optional time to UTC for use as a parameter, as times are
+// only ordered correctly as text when they share a time zone
+func utc(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+
+	return t.UTC()
+}
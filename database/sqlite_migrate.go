@@ -0,0 +1,249 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/metrics"
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/migrate"
+	"go.uber.org/zap"
+)
+
+// MigrationVersion returns the schema version recorded in goose_db_version,
+// or 0 if no migrations have been applied
+func (s *SQLiteStore) MigrationVersion(ctx context.Context) (int64, error) {
+	defer metrics.ObserveQuery("MigrationVersion", time.Now())
+
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	return sqliteMigrationVersion(ctx, s.Conn)
+}
+
+// sqliteQuerier is satisfied by both sql.DB and sql.Tx
+type sqliteQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func sqliteMigrationVersion(ctx context.Context, conn sqliteQuerier) (int64, error) {
+	var exists bool
+
+	// sqlite has no error code for a missing table, so look for it instead
+	err := conn.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'goose_db_version');").
+		Scan(&exists)
+
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	rows, err := conn.QueryContext(ctx, "SELECT version_id, is_applied FROM goose_db_version ORDER BY id DESC;")
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer rows.Close()
+
+	return currentVersion(rows)
+}
+
+// createVersionTable creates the same table, and the same initial row, that
+// goose creates for sqlite
+func (s *SQLiteStore) createVersionTable(ctx context.Context) error {
+	_, err := s.Conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS goose_db_version (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			version_id INTEGER NOT NULL,
+			is_applied INTEGER NOT NULL,
+			tstamp TIMESTAMP DEFAULT (datetime('now'))
+		);
+		INSERT INTO goose_db_version (version_id, is_applied)
+			SELECT 0, true WHERE NOT EXISTS (SELECT 1 FROM goose_db_version);`)
+
+	if err != nil {
+		return fmt.Errorf("creating goose_db_version: %w", err)
+	}
+
+	return nil
+}
+
+// migrateOne applies or rolls back the migration chosen by pick from the
+// current version, in a single transaction. The transaction holds the write
+// lock from the start, so the version cannot change under it. pick returns
+// false if there is nothing to do.
+func (s *SQLiteStore) migrateOne(ctx context.Context, up bool, pick func(version int64) (migrate.Migration, bool, error)) (migrate.Migration, bool, error) {
+	tx, err := s.Conn.BeginTx(ctx, nil)
+
+	if err != nil {
+		return migrate.Migration{}, false, err
+	}
+
+	defer tx.Rollback()
+
+	version, err := sqliteMigrationVersion(ctx, tx)
+
+	if err != nil {
+		return migrate.Migration{}, false, err
+	}
+
+	migration, ok, err := pick(version)
+
+	if err != nil || !ok {
+		return migrate.Migration{}, false, err
+	}
+
+	statements, err := migration.Statements(up)
+
+	if err != nil {
+		return migrate.Migration{}, false, err
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return migrate.Migration{}, false, fmt.Errorf("%s: %w", migration.File, err)
+		}
+	}
+
+	if up {
+		_, err = tx.ExecContext(ctx, "INSERT INTO goose_db_version (version_id, is_applied, tstamp) VALUES (?1, true, ?2);", migration.Version, time.Now().UTC())
+	} else {
+		_, err = tx.ExecContext(ctx, "DELETE FROM goose_db_version WHERE version_id = ?1;", migration.Version)
+	}
+
+	if err != nil {
+		return migrate.Migration{}, false, err
+	}
+
+	return migration, true, tx.Commit()
+}
+
+// MigrateUp applies every embedded sqlite migration newer than the current
+// version, oldest first, returning the ones that were applied
+func (s *SQLiteStore) MigrateUp(ctx context.Context) ([]migrate.Migration, error) {
+	migrations, err := migrate.List(migrate.SQLite)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.createVersionTable(ctx); err != nil {
+		return nil, err
+	}
+
+	var applied []migrate.Migration
+
+	for _, next := range migrations {
+		next := next
+
+		migration, ok, err := s.migrateOne(ctx, true, func(version int64) (migrate.Migration, bool, error) {
+			return next, next.Version > version, nil
+		})
+
+		if err != nil {
+			return applied, err
+		}
+
+		if ok {
+			s.log.Info("applied migration", zap.Int64("version", migration.Version), zap.String("name", migration.Name))
+			applied = append(applied, migration)
+		}
+	}
+
+	return applied, nil
+}
+
+// MigrateDown rolls back the most recently applied migration, returning it
+func (s *SQLiteStore) MigrateDown(ctx context.Context) (migrate.Migration, error) {
+	migrations, err := migrate.List(migrate.SQLite)
+
+	if err != nil {
+		return migrate.Migration{}, err
+	}
+
+	if err := s.createVersionTable(ctx); err != nil {
+		return migrate.Migration{}, err
+	}
+
+	migration, _, err := s.migrateOne(ctx, false, func(version int64) (migrate.Migration, bool, error) {
+		if version == 0 {
+			return migrate.Migration{}, false, ErrNothingToRollBack
+		}
+
+		for _, migration := range migrations {
+			if migration.Version == version {
+				return migration, true, nil
+			}
+		}
+
+		return migrate.Migration{}, false, fmt.Errorf("version %d is not one of the embedded migrations", version)
+	})
+
+	if err != nil {
+		return migrate.Migration{}, err
+	}
+
+	s.log.Info("rolled back migration", zap.Int64("version", migration.Version), zap.String("name", migration.Name))
+	return migration, nil
+}
+
+// MigrationStatus returns every embedded sqlite migration, oldest first, with
+// the time it was applied at
+func (s *SQLiteStore) MigrationStatus(ctx context.Context) ([]MigrationState, error) {
+	migrations, err := migrate.List(migrate.SQLite)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.createVersionTable(ctx); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.Conn.QueryContext(ctx, "SELECT version_id, is_applied, tstamp FROM goose_db_version ORDER BY id;")
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	applied := map[int64]time.Time{}
+
+	for rows.Next() {
+		var version int64
+		var isApplied bool
+		var at time.Time
+
+		if err := rows.Scan(&version, &isApplied, &at); err != nil {
+			return nil, err
+		}
+
+		// rows are read oldest first, so a later roll back wins
+		if isApplied {
+			applied[version] = at
+		} else {
+			delete(applied, version)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	out := make([]MigrationState, 0, len(migrations))
+
+	for _, migration := range migrations {
+		state := MigrationState{Migration: migration}
+
+		if at, ok := applied[migration.Version]; ok {
+			state.AppliedAt = &at
+		}
+
+		out = append(out, state)
+	}
+
+	return out, nil
+}
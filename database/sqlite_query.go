@@ -0,0 +1,789 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/common"
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/metrics"
+	"go.uber.org/zap"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// the sqlite queries mirror query.go. Parameters are numbered ?1, ?2 rather
+// than $1, $2, which sqlite would treat as names, and every time is passed in
+// UTC rather than using now(), see sqliteParams.
+
+func (s *SQLiteStore) AddFingerprint(ctx context.Context, fp string, ip string) (GetFingerprintResult, error) {
+	defer metrics.ObserveQuery("AddFingerprint", time.Now())
+
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	now := time.Now().UTC()
+	out := GetFingerprintResult{Fingerprint: fp, ProxyIP: ip, CreatedAt: &now}
+
+	// sources are never deleted, so the source cannot go between the statements
+	_, err := s.Conn.ExecContext(ctx, "INSERT INTO sources (proxy_ip, created_at) VALUES (?1, ?2) ON CONFLICT (proxy_ip) DO NOTHING;", ip, now)
+
+	if err != nil {
+		return GetFingerprintResult{}, err
+	}
+
+	err = s.Conn.QueryRowContext(
+		ctx,
+		"INSERT INTO fingerprints (fingerprint, source_id, created_at) SELECT ?1, id, ?3 FROM sources WHERE proxy_ip = ?2 RETURNING id;",
+		fp, ip, now,
+	).Scan(&out.ID)
+
+	return out, err
+}
+
+func (s *SQLiteStore) CountFingerprints(ctx context.Context) (uint64, error) {
+	defer metrics.ObserveQuery("CountFingerprints", time.Now())
+
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	var out uint64
+	err := s.Conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM fingerprints;").Scan(&out)
+
+	return out, err
+}
+
+func (s *SQLiteStore) CountFingerprintsByPeriod(ctx context.Context, since time.Time, period string) ([]InsertBucket, error) {
+	defer metrics.ObserveQuery("CountFingerprintsByPeriod", time.Now())
+
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	var out []InsertBucket
+
+	const bucketLayout = "2006-01-02 15:04:05"
+	format := "%Y-%m-%d %H:00:00"
+
+	if period == "day" {
+		format = "%Y-%m-%d 00:00:00"
+	}
+
+	rows, err := s.Conn.QueryContext(
+		ctx,
+		"SELECT strftime(?1, created_at) AS bucket, COUNT(*) FROM fingerprints WHERE created_at >= ?2 GROUP BY bucket ORDER BY bucket",
+		format, since.UTC(),
+	)
+
+	if err != nil {
+		return out, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var data InsertBucket
+		var start string
+
+		if err := rows.Scan(&start, &data.Count); err != nil {
+			return out, err
+		}
+
+		// strftime gives UTC, without saying so
+		if data.Start, err = time.Parse(bucketLayout, start); err != nil {
+			return out, err
+		}
+
+		out = append(out, data)
+	}
+
+	return out, rows.Err()
+}
+
+func (s *SQLiteStore) GetRandomFingerprint(ctx context.Context) (GetFingerprintResult, error) {
+	defer metrics.ObserveQuery("GetRandomFingerprint", time.Now())
+
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	var out GetFingerprintResult
+
+	err := s.Conn.QueryRowContext(ctx, selectFingerprints+" ORDER BY random() LIMIT 1").
+		Scan(&out.ID, &out.Fingerprint, &out.ProxyIP, &out.CreatedAt)
+
+	if err != nil && errors.Is(err, sql.ErrNoRows) {
+		return out, ErrFingerprintNotFound
+	}
+
+	return out, err
+}
+
+func (s *SQLiteStore) GetSpecificFingerprint(ctx context.Context, id uint64) (GetFingerprintResult, error) {
+	defer metrics.ObserveQuery("GetSpecificFingerprint", time.Now())
+
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	var out GetFingerprintResult
+
+	err := s.Conn.QueryRowContext(ctx, selectFingerprints+" WHERE f.id = ?1 LIMIT 1;", id).
+		Scan(&out.ID, &out.Fingerprint, &out.ProxyIP, &out.CreatedAt)
+
+	if err != nil && errors.Is(err, sql.ErrNoRows) {
+		return out, ErrFingerprintNotFound
+	}
+
+	return out, err
+}
+
+func (s *SQLiteStore) ListFingerprints(ctx context.Context, options ListFingerprintsOptions) ([]GetFingerprintResult, error) {
+	defer metrics.ObserveQuery("ListFingerprints", time.Now())
+
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	var out []GetFingerprintResult
+
+	var conditions []string
+	var args []interface{}
+
+	if options.BeforeID != nil {
+		args = append(args, *options.BeforeID)
+		conditions = append(conditions, fmt.Sprintf("f.id < ?%d", len(args)))
+	}
+
+	if options.SinceID != nil {
+		args = append(args, *options.SinceID)
+		conditions = append(conditions, fmt.Sprintf("f.id > ?%d", len(args)))
+	}
+
+	if options.ProxyIP != nil {
+		args = append(args, *options.ProxyIP)
+		conditions = append(conditions, fmt.Sprintf("f.source_id = (SELECT id FROM sources WHERE proxy_ip = ?%d)", len(args)))
+	}
+
+	query := selectFingerprints
+
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	args = append(args, options.Limit)
+	query += fmt.Sprintf(" ORDER BY f.id DESC LIMIT ?%d", len(args))
+
+	rows, err := s.Conn.QueryContext(ctx, query, args...)
+
+	if err != nil {
+		return out, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var data GetFingerprintResult
+
+		if err := rows.Scan(&data.ID, &data.Fingerprint, &data.ProxyIP, &data.CreatedAt); err != nil {
+			return out, err
+		}
+
+		out = append(out, data)
+	}
+
+	return out, rows.Err()
+}
+
+func (s *SQLiteStore) StreamFingerprints(ctx context.Context, fn func(GetFingerprintResult) error) error {
+	rows, err := s.Conn.QueryContext(ctx, selectFingerprints+" ORDER BY f.id DESC")
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var data GetFingerprintResult
+
+		if err := rows.Scan(&data.ID, &data.Fingerprint, &data.ProxyIP, &data.CreatedAt); err != nil {
+			return err
+		}
+
+		if err := fn(data); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (s *SQLiteStore) CheckRetention(ctx context.Context, policy RetentionPolicy) (RetentionReport, error) {
+	defer metrics.ObserveQuery("CheckRetention", time.Now())
+
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	var out RetentionReport
+
+	var limits []string
+	var args []interface{}
+
+	if policy.MaxAge > 0 {
+		args = append(args, time.Now().Add(-policy.MaxAge).UTC())
+		limits = append(limits, fmt.Sprintf("(SELECT MAX(id) FROM fingerprints WHERE created_at < ?%d)", len(args)))
+	}
+
+	if policy.MaxRows > 0 {
+		args = append(args, policy.MaxRows)
+		limits = append(limits, fmt.Sprintf("(SELECT id FROM fingerprints ORDER BY id DESC LIMIT 1 OFFSET ?%d)", len(args)))
+	}
+
+	if len(limits) == 0 {
+		return out, nil
+	}
+
+	// unlike GREATEST in postgres, MAX with more than one argument is null if
+	// any of them are, so the limits that match nothing are counted as 0
+	for i, limit := range limits {
+		limits[i] = "COALESCE(" + limit + ", 0)"
+	}
+
+	boundary := limits[0]
+
+	if len(limits) > 1 {
+		boundary = "MAX(" + strings.Join(limits, ", ") + ")"
+	}
+
+	var maxID sql.NullInt64
+
+	err := s.Conn.QueryRowContext(
+		ctx,
+		fmt.Sprintf("SELECT COUNT(*), MAX(id), MIN(created_at), MAX(created_at) FROM fingerprints WHERE id <= %s;", boundary),
+		args...,
+	).Scan(&out.Count, &maxID, nullTime{&out.Oldest}, nullTime{&out.Newest})
+
+	if err != nil {
+		return RetentionReport{}, err
+	}
+
+	out.MaxID = uint64(maxID.Int64)
+
+	return out, nil
+}
+
+func (s *SQLiteStore) DeleteFingerprintsUpTo(ctx context.Context, maxID uint64, limit uint64) (uint64, error) {
+	defer metrics.ObserveQuery("DeleteFingerprintsUpTo", time.Now())
+
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	result, err := s.Conn.ExecContext(
+		ctx,
+		"DELETE FROM fingerprints WHERE id IN (SELECT id FROM fingerprints WHERE id <= ?1 ORDER BY id LIMIT ?2);",
+		maxID, limit,
+	)
+
+	if err != nil {
+		return 0, err
+	}
+
+	deleted, err := result.RowsAffected()
+
+	return uint64(deleted), err
+}
+
+func (s *SQLiteStore) CheckAuthValid(ctx context.Context, token string) (GetAuthResult, error) {
+	defer metrics.ObserveQuery("CheckAuthValid", time.Now())
+
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	if len(token) != common.TokenLength {
+		return GetAuthResult{Valid: false}, nil
+	}
+
+	rows, err := s.Conn.QueryContext(ctx, "SELECT user_id, permissions, token_salt, token_hash, expires_at FROM auth WHERE token_prefix = ?1", tokenPrefix(token))
+
+	if err != nil {
+		return GetAuthResult{}, err
+	}
+
+	defer rows.Close()
+
+	// prefixes are not unique, so every candidate has to be checked
+	for rows.Next() {
+		var out GetAuthResult
+		var salt, hash []byte
+		var expiresAt *time.Time
+
+		if err := rows.Scan(&out.UserId, &out.Permissions, &salt, &hash, &expiresAt); err != nil {
+			return GetAuthResult{}, err
+		}
+
+		if !verifyToken(token, salt, hash) {
+			continue
+		}
+
+		if expiresAt != nil && !time.Now().Before(*expiresAt) {
+			return GetAuthResult{}, ErrTokenExpired
+		}
+
+		out.Valid = true
+		return out, nil
+	}
+
+	return GetAuthResult{Valid: false}, rows.Err()
+}
+
+func (s *SQLiteStore) CheckCertAuth(ctx context.Context, subject string) (GetAuthResult, error) {
+	defer metrics.ObserveQuery("CheckCertAuth", time.Now())
+
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	var out GetAuthResult
+	var expiresAt *time.Time
+
+	err := s.Conn.QueryRowContext(ctx, "SELECT user_id, permissions, expires_at FROM auth WHERE cert_subject = ?1", subject).
+		Scan(&out.UserId, &out.Permissions, &expiresAt)
+
+	if err != nil && errors.Is(err, sql.ErrNoRows) {
+		return GetAuthResult{Valid: false}, nil
+	}
+
+	if err != nil {
+		return GetAuthResult{}, err
+	}
+
+	if expiresAt != nil && !time.Now().Before(*expiresAt) {
+		return GetAuthResult{}, ErrTokenExpired
+	}
+
+	out.Valid = true
+	return out, nil
+}
+
+func (s *SQLiteStore) GetAllUsers(ctx context.Context) ([]GetUserResult, error) {
+	defer metrics.ObserveQuery("GetAllUsers", time.Now())
+
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	var out []GetUserResult
+
+	rows, err := s.Conn.QueryContext(ctx, "SELECT user_id, permissions, token_prefix, label, created_at, expires_at, last_used_at, cert_subject FROM auth ORDER BY user_id")
+
+	if err != nil {
+		return out, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var data GetUserResult
+
+		err = rows.Scan(&data.UserId, &data.Permissions, &data.TokenPrefix, &data.Label, &data.CreatedAt, &data.ExpiresAt, &data.LastUsedAt, &data.CertSubject)
+
+		if err != nil {
+			return out, err
+		}
+
+		out = append(out, data)
+	}
+
+	return out, rows.Err()
+}
+
+func (s *SQLiteStore) GetUser(ctx context.Context, userId uint64) (GetUserResult, error) {
+	defer metrics.ObserveQuery("GetUser", time.Now())
+
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	var data GetUserResult
+
+	err := s.Conn.QueryRowContext(ctx, "SELECT user_id, permissions, token_prefix, label, created_at, expires_at, last_used_at, cert_subject FROM auth WHERE user_id = ?1;", userId).
+		Scan(&data.UserId, &data.Permissions, &data.TokenPrefix, &data.Label, &data.CreatedAt, &data.ExpiresAt, &data.LastUsedAt, &data.CertSubject)
+
+	if err != nil && errors.Is(err, sql.ErrNoRows) {
+		return data, ErrUserNotFound
+	}
+
+	return data, err
+}
+
+func (s *SQLiteStore) HasAdmin(ctx context.Context) (bool, error) {
+	defer metrics.ObserveQuery("HasAdmin", time.Now())
+
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	var out bool
+
+	err := s.Conn.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM auth WHERE permissions & ?1 != 0);", common.PermissionAdmin).
+		Scan(&out)
+
+	return out, err
+}
+
+// BootstrapAdmin creates the first admin user, returning its token. Every
+// transaction takes the write lock when it begins (see sqliteParams), so two
+// bootstraps cannot both find no admin.
+func (s *SQLiteStore) BootstrapAdmin(ctx context.Context) (GetUserResult, string, error) {
+	defer metrics.ObserveQuery("BootstrapAdmin", time.Now())
+
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	token := common.GenerateToken()
+	hashed, err := newHashedToken(token)
+
+	if err != nil {
+		return GetUserResult{}, "", err
+	}
+
+	tx, err := s.Conn.BeginTx(ctx, nil)
+
+	if err != nil {
+		return GetUserResult{}, "", err
+	}
+
+	defer tx.Rollback()
+
+	var exists bool
+
+	err = tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM auth WHERE permissions & ?1 != 0);", common.PermissionAdmin).
+		Scan(&exists)
+
+	if err != nil {
+		return GetUserResult{}, "", err
+	}
+
+	if exists {
+		return GetUserResult{}, "", ErrAdminExists
+	}
+
+	out := GetUserResult{
+		Permissions: common.PermissionAll,
+		TokenPrefix: hashed.Prefix,
+		Label:       "bootstrap",
+		CreatedAt:   time.Now().UTC(),
+	}
+
+	err = tx.QueryRowContext(
+		ctx,
+		"INSERT INTO auth (permissions, token_prefix, token_salt, token_hash, label, created_at) VALUES (?1, ?2, ?3, ?4, ?5, ?6) RETURNING user_id;",
+		out.Permissions, hashed.Prefix, hashed.Salt, hashed.Hash, out.Label, out.CreatedAt,
+	).Scan(&out.UserId)
+
+	if err != nil {
+		return GetUserResult{}, "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return GetUserResult{}, "", err
+	}
+
+	return out, token, nil
+}
+
+func (s *SQLiteStore) CreateUser(ctx context.Context, options CreateUserOptions) (GetUserResult, string, error) {
+	defer metrics.ObserveQuery("CreateUser", time.Now())
+
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	token := common.GenerateToken()
+	hashed, err := newHashedToken(token)
+
+	if err != nil {
+		return GetUserResult{}, "", err
+	}
+
+	out := GetUserResult{
+		Permissions: options.Permissions,
+		TokenPrefix: hashed.Prefix,
+		Label:       options.Label,
+		CreatedAt:   time.Now().UTC(),
+		ExpiresAt:   options.ExpiresAt,
+		CertSubject: options.CertSubject,
+	}
+
+	err = s.Conn.QueryRowContext(
+		ctx,
+		"INSERT INTO auth (permissions, token_prefix, token_salt, token_hash, label, created_at, expires_at, cert_subject) VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8) RETURNING user_id;",
+		options.Permissions, hashed.Prefix, hashed.Salt, hashed.Hash, options.Label, out.CreatedAt, utc(options.ExpiresAt), options.CertSubject,
+	).Scan(&out.UserId)
+
+	// the driver does not say which column conflicted, so look for the
+	// subject rather than reading the message
+	if err != nil && sqliteCode(err) == sqlite3.SQLITE_CONSTRAINT_UNIQUE && options.CertSubject != nil {
+		var taken bool
+
+		if lookupErr := s.Conn.QueryRowContext(
+			ctx,
+			"SELECT EXISTS (SELECT 1 FROM auth WHERE cert_subject = ?1);",
+			options.CertSubject,
+		).Scan(&taken); lookupErr == nil && taken {
+			return GetUserResult{}, "", ErrCertSubjectTaken
+		}
+	}
+
+	if err != nil {
+		return GetUserResult{}, "", err
+	}
+
+	return out, token, nil
+}
+
+func (s *SQLiteStore) RotateToken(ctx context.Context, userId uint64) (GetUserResult, string, error) {
+	defer metrics.ObserveQuery("RotateToken", time.Now())
+
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	token := common.GenerateToken()
+	hashed, err := newHashedToken(token)
+
+	if err != nil {
+		return GetUserResult{}, "", err
+	}
+
+	result, err := s.Conn.ExecContext(
+		ctx,
+		"UPDATE auth SET token_prefix = ?2, token_salt = ?3, token_hash = ?4 WHERE user_id = ?1;",
+		userId, hashed.Prefix, hashed.Salt, hashed.Hash,
+	)
+
+	if err != nil {
+		return GetUserResult{}, "", err
+	}
+
+	updated, err := result.RowsAffected()
+
+	if err != nil {
+		return GetUserResult{}, "", err
+	}
+
+	if updated == 0 {
+		return GetUserResult{}, "", ErrUserNotFound
+	}
+
+	out := GetUserResult{UserId: userId}
+
+	// read separately, the driver does not parse times returned by RETURNING
+	err = s.Conn.QueryRowContext(
+		ctx,
+		"SELECT permissions, token_prefix, label, created_at, expires_at, last_used_at, cert_subject FROM auth WHERE user_id = ?1;",
+		userId,
+	).Scan(&out.Permissions, &out.TokenPrefix, &out.Label, &out.CreatedAt, &out.ExpiresAt, &out.LastUsedAt, &out.CertSubject)
+
+	if err != nil {
+		return GetUserResult{}, "", err
+	}
+
+	// console sessions were started with the old token, so they go with it
+	if _, err := s.Conn.ExecContext(ctx, "DELETE FROM console_sessions WHERE user_id = ?1;", userId); err != nil {
+		s.log.Warn("could not remove console sessions", zap.Uint64("user", userId), zap.Error(err))
+	}
+
+	return out, token, nil
+}
+
+func (s *SQLiteStore) RevokeUser(ctx context.Context, userId uint64) error {
+	defer metrics.ObserveQuery("RevokeUser", time.Now())
+
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	result, err := s.Conn.ExecContext(ctx, "DELETE FROM auth WHERE user_id = ?1;", userId)
+
+	if err != nil {
+		return err
+	}
+
+	deleted, err := result.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if deleted == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+func (s *SQLiteStore) HitRateLimit(ctx context.Context, userId uint64, windowStart time.Time, dayStart time.Time) (RateLimitCounts, error) {
+	defer metrics.ObserveQuery("HitRateLimit", time.Now())
+
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	var out RateLimitCounts
+
+	// sqlite has no writes inside WITH, so the two counters are separate statements
+	const hit = `
+		INSERT INTO rate_limit_counters (user_id, bucket, window_start, count) VALUES (?1, ?2, ?3, 1)
+		ON CONFLICT (user_id, bucket, window_start) DO UPDATE SET count = count + 1
+		RETURNING count;`
+
+	if err := s.Conn.QueryRowContext(ctx, hit, userId, "window", windowStart.UTC()).Scan(&out.Window); err != nil {
+		return RateLimitCounts{}, err
+	}
+
+	if err := s.Conn.QueryRowContext(ctx, hit, userId, "day", dayStart.UTC()).Scan(&out.Day); err != nil {
+		return RateLimitCounts{}, err
+	}
+
+	// the first request of a window means the previous ones are finished with
+	if out.Window == 1 {
+		_, err := s.Conn.ExecContext(
+			ctx,
+			"DELETE FROM rate_limit_counters WHERE user_id = ?1 AND ((bucket = 'window' AND window_start < ?2) OR (bucket = 'day' AND window_start < ?3));",
+			userId, windowStart.UTC(), dayStart.UTC(),
+		)
+
+		if err != nil {
+			s.log.Warn("could not remove old rate limit counters", zap.Uint64("user", userId), zap.Error(err))
+		}
+	}
+
+	return out, nil
+}
+
+func (s *SQLiteStore) AddAuditLog(ctx context.Context, entry AuditLogEntry) error {
+	defer metrics.ObserveQuery("AddAuditLog", time.Now())
+
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	_, err := s.Conn.ExecContext(
+		ctx,
+		"INSERT INTO audit_log (created_at, request_id, user_id, method, route, status, duration_ms, remote_addr) VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8);",
+		time.Now().UTC(), entry.RequestID, entry.UserId, entry.Method, entry.Route, entry.Status, entry.Duration.Milliseconds(), entry.RemoteAddr,
+	)
+
+	return err
+}
+
+func (s *SQLiteStore) GetAuditLog(ctx context.Context, filter AuditLogFilter) ([]AuditLogEntry, error) {
+	defer metrics.ObserveQuery("GetAuditLog", time.Now())
+
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	var out []AuditLogEntry
+
+	var userId interface{}
+
+	if filter.UserId != nil {
+		userId = *filter.UserId
+	}
+
+	rows, err := s.Conn.QueryContext(
+		ctx,
+		`SELECT id, created_at, request_id, user_id, method, route, status, duration_ms, remote_addr FROM audit_log
+		WHERE (?1 IS NULL OR created_at >= ?1)
+			AND (?2 IS NULL OR created_at < ?2)
+			AND (?3 IS NULL OR user_id = ?3)
+		ORDER BY created_at DESC, id DESC
+		LIMIT ?4`,
+		utc(filter.Since), utc(filter.Until), userId, filter.Limit,
+	)
+
+	if err != nil {
+		return out, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var data AuditLogEntry
+		var durationMs int64
+
+		err = rows.Scan(&data.ID, &data.CreatedAt, &data.RequestID, &data.UserId, &data.Method, &data.Route, &data.Status, &durationMs, &data.RemoteAddr)
+
+		if err != nil {
+			return out, err
+		}
+
+		data.Duration = time.Duration(durationMs) * time.Millisecond
+		out = append(out, data)
+	}
+
+	return out, rows.Err()
+}
+
+func (s *SQLiteStore) CreateSession(ctx context.Context, userId uint64, ttl time.Duration) (GetSessionResult, string, error) {
+	defer metrics.ObserveQuery("CreateSession", time.Now())
+
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	id := common.GenerateToken()
+	now := time.Now().UTC()
+
+	out := GetSessionResult{
+		UserId:    userId,
+		CsrfToken: common.GenerateToken(),
+		ExpiresAt: now.Add(ttl),
+	}
+
+	// expired sessions are cleaned up whenever someone logs in
+	if _, err := s.Conn.ExecContext(ctx, "DELETE FROM console_sessions WHERE expires_at < ?1;", now); err != nil {
+		return GetSessionResult{}, "", err
+	}
+
+	_, err := s.Conn.ExecContext(
+		ctx,
+		"INSERT INTO console_sessions (id_hash, user_id, csrf_token, created_at, expires_at) VALUES (?1, ?2, ?3, ?4, ?5);",
+		hashSessionId(id), userId, out.CsrfToken, now, out.ExpiresAt,
+	)
+
+	if err != nil {
+		return GetSessionResult{}, "", err
+	}
+
+	err = s.Conn.QueryRowContext(ctx, "SELECT permissions FROM auth WHERE user_id = ?1;", userId).Scan(&out.Permissions)
+
+	if err != nil {
+		return GetSessionResult{}, "", err
+	}
+
+	return out, id, nil
+}
+
+func (s *SQLiteStore) GetSession(ctx context.Context, id string) (GetSessionResult, error) {
+	defer metrics.ObserveQuery("GetSession", time.Now())
+
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	var out GetSessionResult
+
+	err := s.Conn.QueryRowContext(
+		ctx,
+		`SELECT s.user_id, a.permissions, s.csrf_token, s.expires_at FROM console_sessions s
+		JOIN auth a ON a.user_id = s.user_id
+		WHERE s.id_hash = ?1 AND s.expires_at > ?2 AND (a.expires_at IS NULL OR a.expires_at > ?2)`,
+		hashSessionId(id), time.Now().UTC(),
+	).Scan(&out.UserId, &out.Permissions, &out.CsrfToken, &out.ExpiresAt)
+
+	if err != nil && errors.Is(err, sql.ErrNoRows) {
+		return GetSessionResult{}, ErrSessionNotFound
+	}
+
+	return out, err
+}
+
+func (s *SQLiteStore) DeleteSession(ctx context.Context, id string) error {
+	defer metrics.ObserveQuery("DeleteSession", time.Now())
+
+	ctx, cancel := s.withQueryTimeout(ctx)
+	defer cancel()
+
+	_, err := s.Conn.ExecContext(ctx, "DELETE FROM console_sessions WHERE id_hash = ?1;", hashSessionId(id))
+	return err
+}
@@ -0,0 +1,366 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/common"
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/migrate"
+)
+
+func newTestSQLiteStore(t *testing.T) *SQLiteStore {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	backend, err := Open(ctx, NewDatabaseOptions{URL: "sqlite://" + filepath.Join(t.TempDir(), "test.db")})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := backend.(*SQLiteStore)
+
+	// Close waits for the context to be done
+	t.Cleanup(func() {
+		cancel()
+		s.Close()
+	})
+
+	if _, err := s.MigrateUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestOpenRejectsUnknownSchemes(t *testing.T) {
+	for _, url := range []string{"mysql://localhost/scraper", "scraper.db"} {
+		if _, err := Open(context.Background(), NewDatabaseOptions{URL: url}); err == nil {
+			t.Errorf("%s: expected an error", url)
+		}
+	}
+}
+
+func TestSQLiteVersionBeforeMigrating(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s, err := NewSQLiteStore(ctx, NewDatabaseOptions{URL: "sqlite://" + filepath.Join(t.TempDir(), "test.db")})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version, err := s.MigrationVersion(ctx); err != nil || version != 0 {
+		t.Fatalf("expected version 0, got %d (%v)", version, err)
+	}
+
+	// any other failure is not taken to mean there is no schema
+	s.Conn.Close()
+
+	if _, err := s.MigrationVersion(ctx); err == nil {
+		t.Fatal("expected an error from a closed database")
+	}
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	s := newTestSQLiteStore(t)
+	ctx := context.Background()
+
+	latest, err := migrate.LatestVersion()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version, err := s.MigrationVersion(ctx); err != nil || version != latest {
+		t.Fatalf("expected version %d, got %d (%v)", latest, version, err)
+	}
+
+	// applying again is a no-op
+	if applied, err := s.MigrateUp(ctx); err != nil || len(applied) != 0 {
+		t.Fatalf("expected nothing to apply, got %v (%v)", applied, err)
+	}
+
+	status, err := s.MigrationStatus(ctx)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, state := range status {
+		if state.AppliedAt == nil {
+			t.Errorf("%s is not marked as applied", state.File)
+		}
+	}
+
+	for range status {
+		if _, err := s.MigrateDown(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := s.MigrateDown(ctx); !errors.Is(err, ErrNothingToRollBack) {
+		t.Fatalf("expected ErrNothingToRollBack, got %v", err)
+	}
+}
+
+// rebuilding auth in a migration must keep the users and their sessions
+func TestSQLiteMigrationsKeepUsers(t *testing.T) {
+	s := newTestSQLiteStore(t)
+	ctx := context.Background()
+
+	user, token, err := s.BootstrapAdmin(ctx)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, id, err := s.CreateSession(ctx, user.UserId, time.Hour)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		t.Helper()
+
+		if auth, err := s.CheckAuthValid(ctx, token); err != nil || !auth.Valid {
+			t.Fatalf("expected the token to be valid, got %+v (%v)", auth, err)
+		}
+
+		if _, err := s.GetSession(ctx, id); err != nil {
+			t.Fatalf("expected the session to be kept, got %v", err)
+		}
+	}
+
+	if _, err := s.MigrateDown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	check()
+
+	if _, err := s.MigrateUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	check()
+}
+
+func TestSQLiteFingerprints(t *testing.T) {
+	s := newTestSQLiteStore(t)
+	ctx := context.Background()
+
+	if _, err := s.GetRandomFingerprint(ctx); !errors.Is(err, ErrFingerprintNotFound) {
+		t.Fatalf("expected ErrFingerprintNotFound, got %v", err)
+	}
+
+	for i, ip := range []string{"192.0.2.1:80", "192.0.2.2:80", "192.0.2.1:80"} {
+		added, err := s.AddFingerprint(ctx, "fp", ip)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if added.ID != uint64(i+1) {
+			t.Errorf("expected id %d, got %d", i+1, added.ID)
+		}
+	}
+
+	fp, err := s.GetSpecificFingerprint(ctx, 2)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fp.ProxyIP != "192.0.2.2:80" || fp.CreatedAt == nil || time.Since(*fp.CreatedAt) > time.Minute {
+		t.Errorf("unexpected fingerprint %+v", fp)
+	}
+
+	ip := "192.0.2.1:80"
+	listed, err := s.ListFingerprints(ctx, ListFingerprintsOptions{Limit: 10, ProxyIP: &ip})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(listed) != 2 || listed[0].ID != 3 || listed[1].ID != 1 {
+		t.Errorf("expected fingerprints 3 and 1, got %+v", listed)
+	}
+
+	buckets, err := s.CountFingerprintsByPeriod(ctx, time.Now().Add(-time.Hour*24), "hour")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(buckets) == 0 || buckets[len(buckets)-1].Count == 0 {
+		t.Errorf("expected the fingerprints to be counted, got %+v", buckets)
+	}
+
+	report, err := s.CheckRetention(ctx, RetentionPolicy{MaxRows: 1})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Count != 2 || report.MaxID != 2 || report.Oldest == nil {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	if deleted, err := s.DeleteFingerprintsUpTo(ctx, report.MaxID, 10); err != nil || deleted != 2 {
+		t.Fatalf("expected 2 deleted, got %d (%v)", deleted, err)
+	}
+
+	// ids are not reused once deleted
+	if added, err := s.AddFingerprint(ctx, "fp", ip); err != nil || added.ID != 4 {
+		t.Errorf("expected id 4, got %d (%v)", added.ID, err)
+	}
+}
+
+func TestSQLiteUsers(t *testing.T) {
+	s := newTestSQLiteStore(t)
+	ctx := context.Background()
+
+	admin, token, err := s.BootstrapAdmin(ctx)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := s.BootstrapAdmin(ctx); !errors.Is(err, ErrAdminExists) {
+		t.Fatalf("expected ErrAdminExists, got %v", err)
+	}
+
+	auth, err := s.CheckAuthValid(ctx, token)
+
+	if err != nil || !auth.Valid || auth.UserId != admin.UserId {
+		t.Fatalf("expected the admin token to be valid, got %+v (%v)", auth, err)
+	}
+
+	subject := "CN=client"
+	past := time.Now().Add(-time.Minute)
+
+	user, _, err := s.CreateUser(ctx, CreateUserOptions{Permissions: common.PermissionUseAPI, CertSubject: &subject, ExpiresAt: &past})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := s.CreateUser(ctx, CreateUserOptions{CertSubject: &subject}); !errors.Is(err, ErrCertSubjectTaken) {
+		t.Fatalf("expected ErrCertSubjectTaken, got %v", err)
+	}
+
+	if _, err := s.CheckCertAuth(ctx, subject); !errors.Is(err, ErrTokenExpired) {
+		t.Fatalf("expected ErrTokenExpired, got %v", err)
+	}
+
+	session, id, err := s.CreateSession(ctx, admin.UserId, time.Hour)
+
+	if err != nil || session.Permissions != common.PermissionAll {
+		t.Fatalf("unexpected session %+v (%v)", session, err)
+	}
+
+	if _, err := s.GetSession(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+
+	// rotating ends the sessions started with the old token
+	rotated, newToken, err := s.RotateToken(ctx, admin.UserId)
+
+	if err != nil || rotated.Label != "bootstrap" {
+		t.Fatalf("unexpected rotated user %+v (%v)", rotated, err)
+	}
+
+	if auth, _ := s.CheckAuthValid(ctx, token); auth.Valid {
+		t.Error("expected the old token to be invalid")
+	}
+
+	if auth, _ := s.CheckAuthValid(ctx, newToken); !auth.Valid {
+		t.Error("expected the new token to be valid")
+	}
+
+	if _, err := s.GetSession(ctx, id); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+
+	// buffered, not written by the request that authenticated
+	s.MarkUsed(admin.UserId)
+
+	if users, err := s.GetAllUsers(ctx); err != nil || users[0].LastUsedAt != nil {
+		t.Fatalf("expected the last used time to wait for a flush, got %+v (%v)", users, err)
+	}
+
+	s.lastUsed.flush(ctx)
+
+	users, err := s.GetAllUsers(ctx)
+
+	if err != nil || len(users) != 2 || users[0].LastUsedAt == nil {
+		t.Fatalf("unexpected users %+v (%v)", users, err)
+	}
+
+	if got, err := s.GetUser(ctx, user.UserId); err != nil || got.CertSubject == nil || *got.CertSubject != subject {
+		t.Fatalf("unexpected user %+v (%v)", got, err)
+	}
+
+	if err := s.RevokeUser(ctx, user.UserId); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.GetUser(ctx, user.UserId); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("expected ErrUserNotFound, got %v", err)
+	}
+
+	// the id of the revoked user is not given out again
+	if created, _, err := s.CreateUser(ctx, CreateUserOptions{}); err != nil || created.UserId != user.UserId+1 {
+		t.Fatalf("expected id %d, got %d (%v)", user.UserId+1, created.UserId, err)
+	}
+
+	if err := s.RevokeUser(ctx, user.UserId); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("expected ErrUserNotFound, got %v", err)
+	}
+}
+
+func TestSQLiteRateLimitAndAudit(t *testing.T) {
+	s := newTestSQLiteStore(t)
+	ctx := context.Background()
+
+	window := time.Now().Truncate(time.Minute)
+	day := time.Now().Truncate(time.Hour * 24)
+
+	for i := uint64(1); i <= 3; i++ {
+		counts, err := s.HitRateLimit(ctx, 1, window, day)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if counts.Window != i || counts.Day != i {
+			t.Fatalf("expected %d requests counted, got %+v", i, counts)
+		}
+	}
+
+	for _, userId := range []uint64{1, 2, 1} {
+		if err := s.AddAuditLog(ctx, AuditLogEntry{RequestID: "req", UserId: userId, Method: "GET", Route: "/", Status: 200}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	userId := uint64(1)
+	since := time.Now().Add(-time.Minute)
+
+	entries, err := s.GetAuditLog(ctx, AuditLogFilter{UserId: &userId, Since: &since, Limit: 10})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 || entries[0].ID != 3 {
+		t.Fatalf("expected entries 3 and 1, got %+v", entries)
+	}
+}
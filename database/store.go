@@ -0,0 +1,135 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/common"
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/migrate"
+	"go.uber.org/zap"
+)
+
+// Store is everything the api reads and writes. Database implements it over
+// postgres, SQLiteStore over sqlite, and MemoryStore implements it in memory
+// for tests and demo mode.
+type Store interface {
+	CountFingerprints(ctx context.Context) (uint64, error)
+	CountFingerprintsByPeriod(ctx context.Context, since time.Time, period string) ([]InsertBucket, error)
+	GetRandomFingerprint(ctx context.Context) (GetFingerprintResult, error)
+	GetSpecificFingerprint(ctx context.Context, id uint64) (GetFingerprintResult, error)
+	ListFingerprints(ctx context.Context, options ListFingerprintsOptions) ([]GetFingerprintResult, error)
+	StreamFingerprints(ctx context.Context, fn func(GetFingerprintResult) error) error
+
+	CheckRetention(ctx context.Context, policy RetentionPolicy) (RetentionReport, error)
+	DeleteFingerprintsUpTo(ctx context.Context, maxID uint64, limit uint64) (uint64, error)
+
+	CheckAuthValid(ctx context.Context, token string) (GetAuthResult, error)
+	CheckCertAuth(ctx context.Context, subject string) (GetAuthResult, error)
+	MarkUsed(userId uint64)
+
+	GetAllUsers(ctx context.Context) ([]GetUserResult, error)
+	GetUser(ctx context.Context, userId uint64) (GetUserResult, error)
+	HasAdmin(ctx context.Context) (bool, error)
+	BootstrapAdmin(ctx context.Context) (GetUserResult, string, error)
+	CreateUser(ctx context.Context, options CreateUserOptions) (GetUserResult, string, error)
+	RotateToken(ctx context.Context, userId uint64) (GetUserResult, string, error)
+	RevokeUser(ctx context.Context, userId uint64) error
+
+	HitRateLimit(ctx context.Context, userId uint64, windowStart time.Time, dayStart time.Time) (RateLimitCounts, error)
+
+	AddAuditLog(ctx context.Context, entry AuditLogEntry) error
+	GetAuditLog(ctx context.Context, filter AuditLogFilter) ([]AuditLogEntry, error)
+
+	CreateSession(ctx context.Context, userId uint64, ttl time.Duration) (GetSessionResult, string, error)
+	GetSession(ctx context.Context, id string) (GetSessionResult, error)
+	DeleteSession(ctx context.Context, id string) error
+
+	Ping(ctx context.Context) error
+	MigrationVersion(ctx context.Context) (int64, error)
+	InsertStats() InsertStats
+	PoolStats() PoolStats
+}
+
+// Backend is a Store that persists, along with what main and the subcommands
+// need to manage it
+type Backend interface {
+	Store
+
+	MigrateUp(ctx context.Context) ([]migrate.Migration, error)
+	MigrateDown(ctx context.Context) (migrate.Migration, error)
+	MigrationStatus(ctx context.Context) ([]MigrationState, error)
+
+	ListenForNewFingerprints(channel common.FingerprintResultChannel)
+	Close()
+}
+
+var _ Backend = (*Database)(nil)
+var _ Backend = (*SQLiteStore)(nil)
+var _ Store = (*MemoryStore)(nil)
+
+// Open connects to the backend named by the scheme of options.URL, postgres://
+// (or postgresql://) for Database and sqlite:// for SQLiteStore
+func Open(ctx context.Context, options NewDatabaseOptions) (Backend, error) {
+	switch {
+	case strings.HasPrefix(options.URL, "postgres://"), strings.HasPrefix(options.URL, "postgresql://"):
+		return NewDatabase(ctx, options)
+	case strings.HasPrefix(options.URL, "sqlite://"):
+		return NewSQLiteStore(ctx, options)
+	}
+
+	// the rest of the url is not included, it may hold a password
+	scheme, _, ok := strings.Cut(options.URL, "://")
+
+	if !ok {
+		return nil, errors.New("the database url has no scheme, expected postgres:// or sqlite://")
+	}
+
+	return nil, fmt.Errorf("unsupported database url scheme %q, expected postgres:// or sqlite://", scheme)
+}
+
+// insertCounts counts the fingerprints received by ListenForNewFingerprints
+type insertCounts struct {
+	inserted atomic.Uint64
+	failed   atomic.Uint64
+}
+
+func (c *insertCounts) stats() InsertStats {
+	return InsertStats{
+		Inserted: c.inserted.Load(),
+		Failed:   c.failed.Load(),
+	}
+}
+
+// listenForFingerprints stores the results sent on channel with add until ctx
+// is done
+func listenForFingerprints(
+	ctx context.Context,
+	log *zap.Logger,
+	channel common.FingerprintResultChannel,
+	counts *insertCounts,
+	add func(ctx context.Context, fp string, ip string) (GetFingerprintResult, error),
+) {
+Iter:
+	for {
+		select {
+		case <-ctx.Done():
+			break Iter
+
+		case r := <-channel:
+			added, err := add(ctx, r.Fingerprint, r.ProxyIP)
+
+			if err != nil {
+				counts.failed.Add(1)
+				log.Sugar().Errorf("error: %s", err.Error())
+			} else {
+				counts.inserted.Add(1)
+			}
+
+			log.Debug("completed process", zap.Bool("success", err == nil), zap.Uint64("id", added.ID))
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package database
+
+import (
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+)
+
+// the number of leading characters of a token stored in plaintext, used to
+// find candidate rows without revealing the token itself
+const tokenPrefixLength = 8
+
+const tokenSaltLength = 16
+
+type hashedToken struct {
+	Prefix string
+	Salt   []byte
+	Hash   []byte
+}
+
+func tokenPrefix(token string) string {
+	if len(token) < tokenPrefixLength {
+		return token
+	}
+
+	return token[:tokenPrefixLength]
+}
+
+// hashToken must match the hash computed by the hash_auth_tokens migration
+func hashToken(token string, salt []byte) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(token))
+
+	return h.Sum(nil)
+}
+
+func newHashedToken(token string) (hashedToken, error) {
+	salt := make([]byte, tokenSaltLength)
+
+	if _, err := crand.Read(salt); err != nil {
+		return hashedToken{}, err
+	}
+
+	return hashedToken{
+		Prefix: tokenPrefix(token),
+		Salt:   salt,
+		Hash:   hashToken(token, salt),
+	}, nil
+}
+
+func verifyToken(token string, salt []byte, hash []byte) bool {
+	return subtle.ConstantTimeCompare(hashToken(token, salt), hash) == 1
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/database"
+	"go.uber.org/zap"
+)
+
+// how many fingerprints the demo store starts with
+const demoFingerprints = 250
+
+var demoProxies = []string{"192.0.2.10", "192.0.2.11", "198.51.100.7"}
+
+const demoAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+// newDemoStore returns an in-memory store with an admin user, whose token is
+// logged, and fingerprints spread over the last week
+func newDemoStore() *database.MemoryStore {
+	log := zap.L().Named("demo")
+	store := database.NewMemoryStore()
+
+	_, token, err := store.BootstrapAdmin(context.Background())
+
+	if err != nil {
+		log.Fatal("could not create the demo admin", zap.Error(err))
+	}
+
+	now := time.Now()
+	times := make([]time.Time, demoFingerprints)
+
+	for i := range times {
+		times[i] = now.Add(-time.Duration(rand.Int63n(int64(time.Hour * 24 * 7))))
+	}
+
+	// ids are handed out in order, so they should follow the fetch times
+	sort.Slice(times, func(i, j int) bool {
+		return times[i].Before(times[j])
+	})
+
+	for i, at := range times {
+		store.AddFingerprint(demoFingerprint(at), demoProxies[i%len(demoProxies)], at)
+	}
+
+	log.Warn("demo mode: serving sample data from memory, nothing is kept")
+	log.Info("created demo admin", zap.String("token", token))
+
+	return store
+}
+
+// demoFingerprint looks like the fingerprints discord hands out, a snowflake
+// for the time followed by a random part
+func demoFingerprint(at time.Time) string {
+	const discordEpoch = 1420070400000
+
+	snowflake := (at.UnixMilli() - discordEpoch) << 22
+	random := make([]byte, 27)
+
+	for i := range random {
+		random[i] = demoAlphabet[rand.Intn(len(demoAlphabet))]
+	}
+
+	return fmt.Sprintf("%d.%s", snowflake, random)
+}
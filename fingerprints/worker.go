@@ -25,18 +25,16 @@ type NewWorkerOptions struct {
 	Id           int
 	ProxyManager proxy.Manager
 	Context      context.Context
-	Database     *database.Database
+	Database     database.Backend
 	Results      common.FingerprintResultChannel
 }
 
 func NewWorker(options NewWorkerOptions) Worker {
-	ctx, _ := context.WithCancel(options.Context)
-
 	return Worker{
 		ProxyHandler: options.ProxyManager,
 		WorkerID:     options.Id,
 		Log:          zap.L().Named(fmt.Sprintf("fingerprint.worker(id=%d)", options.Id)),
-		ctx:          ctx,
+		ctx:          options.Context,
 		Results:      options.Results,
 	}
 }
@@ -104,8 +102,13 @@ func (w Worker) Handle() {
 		return
 	}
 
-	w.Results <- common.FingerprintResult{
+	// nothing reads results once the context is done
+	select {
+	case <-w.ctx.Done():
+		logger.Info("exiting before the fingerprint was stored")
+	case w.Results <- common.FingerprintResult{
 		Fingerprint: *data.Fingerprint,
 		ProxyIP:     ip,
+	}:
 	}
 }
@@ -3,61 +3,81 @@ package main
 import (
 	"context"
 	"flag"
+	"math"
 	"os"
 	"os/signal"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/getaddrinfo/proxy-fingerprint-scraper/api"
 	"github.com/getaddrinfo/proxy-fingerprint-scraper/common"
 	"github.com/getaddrinfo/proxy-fingerprint-scraper/database"
 	"github.com/getaddrinfo/proxy-fingerprint-scraper/fingerprints"
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/migrate"
 	"github.com/getaddrinfo/proxy-fingerprint-scraper/proxy"
 	"github.com/getaddrinfo/proxy-fingerprint-scraper/proxy/impls/saturable"
 	"github.com/getaddrinfo/proxy-fingerprint-scraper/proxy/ip"
 	"github.com/getaddrinfo/proxy-fingerprint-scraper/proxy/ua"
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/retention"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
-var db *database.Database = nil
+var db database.Backend = nil
 
 var Debug = flag.Bool("debug", false, "enables debug mode")
+var AutoMigrate = flag.Bool("auto-migrate", false, "apply missing migrations at startup instead of refusing to start")
+var Demo = flag.Bool("demo", false, "serve sample data from memory instead of a database, nothing is kept")
 var NumWorkers = flag.Int("workers", 1, "number of concurrent workers the app should use")
 var FeatureFetchNewFingerprints = flag.Bool("fingerprints", false, "fetch new fingerprints")
 var Port = flag.Int("port", 48832, "what port to listen on")
+var Socket = flag.String("socket", "", "listen on this unix socket instead of the port")
+var TLSCert = flag.String("tls-cert", "", "serve https using this certificate file (reloaded when changed)")
+var TLSKey = flag.String("tls-key", "", "the key file for -tls-cert")
+var TLSClientCA = flag.String("tls-client-ca", "", "accept client certificates signed by the CAs in this file, mapped to users by subject")
+var MetricsToken = flag.String("metrics-token", "", "bearer token required to read /metrics (empty to leave it open)")
+var ShutdownGrace = flag.Duration("shutdown-grace", time.Second*15, "how long to wait for in-flight requests when exiting")
+var SecureCookies = flag.Bool("secure-cookies", false, "mark console cookies Secure when serving plain http behind a proxy that terminates TLS")
+var DrainDelay = flag.Duration("drain-delay", 0, "how long to keep serving with /readyz failing before closing the listener when exiting")
+
+var ReadTimeout = flag.Duration("read-timeout", api.DefaultReadTimeout, "maximum time to read a request")
+var WriteTimeout = flag.Duration("write-timeout", api.DefaultWriteTimeout, "maximum time to write a response, including exports")
+var IdleTimeout = flag.Duration("idle-timeout", api.DefaultIdleTimeout, "how long to keep idle connections open")
+var QueryTimeout = flag.Duration("query-timeout", database.DefaultQueryTimeout, "maximum time a single database query may take")
+
+var RateLimitRequests = flag.Uint64("rate-limit", 0, "maximum api requests per user per rate limit window (0 to disable)")
+var RateLimitWindow = flag.Duration("rate-window", time.Minute, "length of the rate limit window")
+var DailyQuota = flag.Uint64("daily-quota", 0, "maximum api requests per user per day (0 to disable)")
+
+var RetentionMaxAge = flag.Duration("retention-max-age", 0, "delete fingerprints fetched longer ago than this (0 to keep them)")
+var RetentionMaxRows = flag.Uint64("retention-max-rows", 0, "delete all but this many of the newest fingerprints (0 to keep them)")
+var RetentionInterval = flag.Duration("retention-interval", retention.DefaultInterval, "how often to delete fingerprints the retention policy no longer keeps")
+var RetentionBatchSize = flag.Uint64("retention-batch", retention.DefaultBatchSize, "the most fingerprints deleted by a single statement")
 
 var UserAgentSource = flag.String("ua", "file", "what source to load user agents from (currently only 'file')")
 var ProxySoure = flag.String("ip", "file", "what source to load proxy ip:port from (currently only 'file')")
 
-var proxyManager proxy.Manager
-
 // makes sure that the program keeps running
 // until it receives an exit sig (one of SIGINT, SIGTERM, SIGHUP for unix)
+// or ctx is cancelled because something it depends on failed
 // os.Interrupt will use platform relevant signals
-func preserve(cancel context.CancelFunc) {
+func preserve(ctx context.Context, cancel context.CancelFunc) {
 	exitSignal := make(chan os.Signal, 1)
-
-	wg := new(sync.WaitGroup)
-	wg.Add(1)
 	signal.Notify(exitSignal, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(exitSignal)
 
-	go func() {
-		sig := <-exitSignal
-
+	select {
+	case sig := <-exitSignal:
 		zap.L().Named("preserver").Info("exiting", zap.String("signal", sig.String()))
 		cancel() // cancel the context
-		wg.Done()
-	}()
-
-	wg.Wait()
-	os.Exit(0)
+	case <-ctx.Done():
+	}
 }
 
-func init() {
-	flag.Parse()
-
+// setupLogging replaces the global logger, it needs the flags to be parsed
+func setupLogging() {
 	config := zap.NewDevelopmentConfig()
 	config.DisableStacktrace = true
 	config.EncoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
@@ -79,8 +99,29 @@ func init() {
 }
 
 func main() {
+	flag.Parse()
+	setupLogging()
+
 	ctx, cancel := context.WithCancel(context.Background())
 
+	dbUrl, present := os.LookupEnv("DATABASE_URL")
+
+	if !present && !*Demo {
+		zap.L().Fatal("DATABASE_URL env variable must be supplied")
+		os.Exit(1)
+	}
+
+	if flag.NArg() > 0 {
+		code := runCommand(ctx, dbUrl, flag.Args())
+		cancel()
+		os.Exit(code)
+	}
+
+	if *Demo && *FeatureFetchNewFingerprints {
+		zap.L().Fatal("fetching fingerprints needs a database, it cannot be used with -demo")
+		os.Exit(1)
+	}
+
 	if *NumWorkers < 1 && *FeatureFetchNewFingerprints {
 		zap.L().Fatal("number of workers must be at least 1")
 		os.Exit(1)
@@ -91,41 +132,191 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *RetentionMaxRows > math.MaxInt64 {
+		zap.L().Fatal("retention max rows must be at most 9223372036854775807")
+		os.Exit(1)
+	}
+
 	if *Debug {
 		zap.L().Warn("debug mode: do not use this in production.")
 	}
 
-	dbUrl, present := os.LookupEnv("DATABASE_URL")
+	zap.L().Info("starting")
 
-	if !present {
-		zap.L().Fatal("DATABASE_URL env variable must be supplied")
-		os.Exit(1)
+	var store database.Store
+
+	if *Demo {
+		store = newDemoStore()
+	} else {
+		store = openDatabase(ctx, dbUrl)
 	}
 
-	zap.L().Info("starting")
+	retentionPolicy := database.RetentionPolicy{
+		MaxAge:  *RetentionMaxAge,
+		MaxRows: *RetentionMaxRows,
+	}
+
+	// everything main has to wait for before exiting
+	wg := new(sync.WaitGroup)
 
-	localDb, err := database.NewDatabase(ctx, dbUrl)
+	// started before the server, which shows the proxies it loads
+	var proxies proxy.Manager
 
+	if *FeatureFetchNewFingerprints {
+		proxies = StartFingerprintFetcher(ctx, wg)
+	}
+
+	svr := newServer(store, proxies, retentionPolicy)
+
+	// without the api there is no point fetching or pruning, so the server
+	// failing to listen or serve stops the process
+	serveErr := make(chan error, 1)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		if err := svr.Run(); err != nil {
+			serveErr <- err
+			cancel()
+		}
+	}()
+
+	if retentionPolicy.Enabled() {
+		pruner := retention.NewPruner(retention.NewPrunerOptions{
+			Store:     store,
+			Policy:    retentionPolicy,
+			Interval:  *RetentionInterval,
+			BatchSize: *RetentionBatchSize,
+		})
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pruner.Run(ctx)
+		}()
+	}
+
+	preserve(ctx, cancel)
+
+	// the grace period starts once the drain delay is over
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), *DrainDelay+*ShutdownGrace)
+	defer cancelShutdown()
+
+	svr.Shutdown(shutdownCtx)
+	wg.Wait()
+
+	// requests and the listener have stopped, nothing else uses the pool
+	if db != nil {
+		db.Close()
+	}
+
+	select {
+	case err := <-serveErr:
+		zap.L().Fatal("exited, the server failed", zap.Error(err))
+	default:
+		zap.L().Info("exited")
+	}
+}
+
+// newServer builds the api server from the flags, with its routes added.
+// proxies is nil when fingerprints are not being fetched.
+func newServer(store database.Store, proxies proxy.Manager, retentionPolicy database.RetentionPolicy) *api.Server {
+	svr := api.NewServer(api.NewServerOptions{
+		Store:        store,
+		ProxyManager: proxies,
+		Port:         *Port,
+		Listener: api.ListenerOptions{
+			Socket:   *Socket,
+			TLSCert:  *TLSCert,
+			TLSKey:   *TLSKey,
+			ClientCA: *TLSClientCA,
+		},
+		RateLimit: api.RateLimitConfig{
+			Requests:   *RateLimitRequests,
+			Window:     *RateLimitWindow,
+			DailyQuota: *DailyQuota,
+		},
+		MetricsToken: *MetricsToken,
+		Retention:    retentionPolicy,
+		DrainDelay:   *DrainDelay,
+
+		SecureCookies: *SecureCookies,
+		Timeouts: api.Timeouts{
+			Read:  *ReadTimeout,
+			Write: *WriteTimeout,
+			Idle:  *IdleTimeout,
+		},
+	})
+	svr.InitRoutes()
+
+	return svr
+}
+
+func openDatabase(ctx context.Context, dbUrl string) database.Backend {
+	localDb, err := database.Open(ctx, database.NewDatabaseOptions{URL: dbUrl, QueryTimeout: *QueryTimeout})
+
+	// serving without a database would only ever respond with errors
 	if err != nil {
-		zap.S().Errorf("could not open db connection: %s", err.Error())
+		zap.S().Fatalf("could not open db connection: %s", err.Error())
+		os.Exit(1)
 	}
 
 	db = localDb
+	checkSchema(ctx)
 
-	svr := api.NewServer(db, proxyManager, *Port)
-	svr.InitRoutes()
-	go svr.Run()
+	if hasAdmin, err := db.HasAdmin(ctx); err == nil && !hasAdmin {
+		zap.L().Warn("no admin user exists, create one with `scraper admin bootstrap`")
+	}
 
-	if *FeatureFetchNewFingerprints {
-		StartFingerprintFetcher(ctx)
+	return db
+}
+
+// checkSchema stops the process if the database is missing migrations this
+// build depends on, unless it may apply them itself
+func checkSchema(ctx context.Context) {
+	log := zap.L().Named("migrate")
+
+	expected, err := migrate.LatestVersion()
+
+	if err != nil {
+		log.Fatal("could not read the embedded migrations", zap.Error(err))
+	}
+
+	// 0 for a database goose has never touched, an error means the version
+	// is unknown, and migrating a live database on a guess is not safe
+	version, err := db.MigrationVersion(ctx)
+
+	if err != nil {
+		log.Fatal("could not read the schema version", zap.Error(err))
 	}
 
-	preserve(cancel)
+	switch {
+	case version == expected:
+		return
+
+	case version > expected:
+		// an older build running during a rolling deploy
+		log.Warn("the schema is newer than this build", zap.Int64("version", version), zap.Int64("expected", expected))
+		return
+
+	case *AutoMigrate:
+		if _, err := db.MigrateUp(ctx); err != nil {
+			log.Fatal("could not apply migrations", zap.Error(err))
+		}
+
+	default:
+		log.Fatal(
+			"the schema is behind this build, run `scraper migrate up` or start with -auto-migrate",
+			zap.Int64("version", version),
+			zap.Int64("expected", expected),
+		)
+	}
 }
 
 // TODO: Move to a map[string]Factory for uaSource and ipSource
 // likely taking a function to config
-func StartFingerprintFetcher(ctx context.Context) {
+func StartFingerprintFetcher(ctx context.Context, wg *sync.WaitGroup) proxy.Manager {
 	zap.S().Named("fingerprint").Info("feature enabled")
 
 	var ipSource ip.Source
@@ -158,10 +349,13 @@ func StartFingerprintFetcher(ctx context.Context) {
 
 	zap.S().Named("fingerprint").Infof("loaded %d proxies", len(proxies.IPs()))
 
-	proxyManager = proxies
 	results := make(common.FingerprintResultChannel)
 
-	go db.ListenForNewFingerprints(results)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		db.ListenForNewFingerprints(results)
+	}()
 
 	zap.S().Infof("starting %d workers", *NumWorkers)
 	for i := 0; i < *NumWorkers; i++ {
@@ -175,4 +369,6 @@ func StartFingerprintFetcher(ctx context.Context) {
 
 		go worker.Run()
 	}
+
+	return proxies
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/api"
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/common"
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/database"
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/proxy"
+)
+
+// staticProxies is a proxy.Manager that only knows its addresses
+type staticProxies []string
+
+func (p staticProxies) Init() error               { return nil }
+func (p staticProxies) IPs() []string             { return p }
+func (p staticProxies) Add(ip string) error       { return nil }
+func (p staticProxies) Get() (proxy.Proxy, error) { return nil, proxy.ErrNoneMatch }
+
+// the server main builds must show the proxies the fetcher loaded
+func TestServerShowsFetcherProxies(t *testing.T) {
+	store := database.NewMemoryStore()
+
+	_, token, err := store.CreateUser(context.Background(), database.CreateUserOptions{
+		Permissions: common.PermissionUseAPI.Add(common.PermissionViewProxies),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svr := newServer(store, staticProxies{"192.0.2.1:80"}, database.RetentionPolicy{})
+
+	r := httptest.NewRequest(http.MethodGet, api.APIPrefix+"/stats", nil)
+	r.Header.Set("Authorization", token)
+
+	w := httptest.NewRecorder()
+	svr.Handler().ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var stats api.StatsResponse
+
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stats.Proxies) != 1 || stats.Proxies[0] != "192.0.2.1:80" {
+		t.Errorf("expected the fetcher's proxies, got %v", stats.Proxies)
+	}
+}
@@ -0,0 +1,97 @@
+// Package metrics holds the prometheus collectors shared by the api and the
+// database, they are registered and served by api.Server
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "scraper"
+
+// reasons a request can fail authentication
+const (
+	AuthMissing      = "missing"
+	AuthInvalid      = "invalid"
+	AuthExpired      = "expired"
+	AuthForbidden    = "forbidden"
+	AuthDefaultToken = "default_token"
+)
+
+var (
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Requests served, by route template, method and status.",
+	}, []string{"route", "method", "status"})
+
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Time taken to serve requests, by route template and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	AuthFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "auth",
+		Name:      "failures_total",
+		Help:      "Requests rejected by authentication, by reason.",
+	}, []string{"reason"})
+
+	DBQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "db",
+		Name:      "query_duration_seconds",
+		Help:      "Time taken by database queries, by store method.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"method"})
+
+	RetentionDeleted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "retention",
+		Name:      "deleted_total",
+		Help:      "Fingerprints deleted by the retention policy.",
+	})
+
+	RetentionFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "retention",
+		Name:      "failures_total",
+		Help:      "Retention runs that stopped because of an error.",
+	})
+)
+
+// Collectors returns every collector declared in this package
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		HTTPRequests,
+		HTTPDuration,
+		AuthFailures,
+		DBQueryDuration,
+		RetentionDeleted,
+		RetentionFailures,
+	}
+}
+
+// ObserveQuery records the time since start against the query method, it is
+// meant to be deferred at the top of the method
+func ObserveQuery(method string, start time.Time) {
+	DBQueryDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+// HTTPMethod returns the method to record for a request, methods outside the
+// standard set are recorded as "other" so clients cannot add label series
+func HTTPMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+
+	return "other"
+}
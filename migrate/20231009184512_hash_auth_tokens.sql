@@ -0,0 +1,38 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE auth
+    ADD COLUMN token_prefix VARCHAR(8),
+    ADD COLUMN token_salt BYTEA,
+    ADD COLUMN token_hash BYTEA;
+
+-- the salt is not secret, it only has to differ between rows
+UPDATE auth SET
+    token_prefix = LEFT(token, 8),
+    token_salt = decode(md5(random()::text || clock_timestamp()::text || user_id::text), 'hex');
+
+UPDATE auth SET token_hash = sha256(token_salt || convert_to(token, 'UTF8'));
+
+ALTER TABLE auth
+    ALTER COLUMN token_prefix SET NOT NULL,
+    ALTER COLUMN token_salt SET NOT NULL,
+    ALTER COLUMN token_hash SET NOT NULL,
+    DROP COLUMN token;
+
+CREATE INDEX IF NOT EXISTS auth_token_prefix_idx ON auth (token_prefix);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+-- hashes cannot be reversed, so every user is given a new random token
+-- which has to be read from the database afterwards
+DROP INDEX IF EXISTS auth_token_prefix_idx;
+
+ALTER TABLE auth ADD COLUMN token VARCHAR(32);
+UPDATE auth SET token = md5(random()::text || clock_timestamp()::text || user_id::text);
+
+ALTER TABLE auth
+    ALTER COLUMN token SET NOT NULL,
+    DROP COLUMN token_prefix,
+    DROP COLUMN token_salt,
+    DROP COLUMN token_hash;
+-- +goose StatementEnd
@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE auth
+    ADD COLUMN label TEXT NOT NULL DEFAULT '',
+    ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    ADD COLUMN expires_at TIMESTAMPTZ,
+    ADD COLUMN last_used_at TIMESTAMPTZ;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE auth
+    DROP COLUMN label,
+    DROP COLUMN created_at,
+    DROP COLUMN expires_at,
+    DROP COLUMN last_used_at;
+-- +goose StatementEnd
@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+-- the seeded admin token is replaced by `scraper admin bootstrap`, so drop it
+-- if it was never changed
+DELETE FROM auth
+WHERE user_id = 0
+    AND token_prefix = 'aaaaaaaa'
+    AND token_hash = sha256(token_salt || convert_to('aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa', 'UTF8'));
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+-- the insecure default token is intentionally not restored
+SELECT 1;
+-- +goose StatementEnd
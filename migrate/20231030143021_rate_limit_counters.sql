@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS rate_limit_counters (
+    user_id BIGINT NOT NULL,
+    bucket VARCHAR(16) NOT NULL,
+    window_start TIMESTAMPTZ NOT NULL,
+    count INT NOT NULL,
+    PRIMARY KEY (user_id, bucket, window_start)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE rate_limit_counters;
+-- +goose StatementEnd
@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+-- drops bits that were never defined (the seeded admin used 15), then grants the
+-- new permissions to whoever could already do those things:
+--  8 (VIEW_PROXIES) to VIEW_HOME_PAGE, the home page always listed proxies
+-- 32 (EXPORT) to USE_API, which could read the whole table
+-- 16 (MANAGE_USERS) and 64 (READ_RECORD) to ADMIN
+UPDATE auth SET permissions = (permissions & 7)
+    | CASE WHEN permissions & 1 != 0 THEN 8 ELSE 0 END
+    | CASE WHEN permissions & 2 != 0 THEN 32 ELSE 0 END
+    | CASE WHEN permissions & 4 != 0 THEN 16 | 64 ELSE 0 END;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+UPDATE auth SET permissions = permissions & 7;
+-- +goose StatementEnd
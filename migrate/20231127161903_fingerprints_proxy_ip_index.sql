@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+-- lets the list endpoint filter by proxy and page through the results by id
+CREATE INDEX IF NOT EXISTS fingerprints_proxy_ip_id_idx ON fingerprints (proxy_ip, id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS fingerprints_proxy_ip_id_idx;
+-- +goose StatementEnd
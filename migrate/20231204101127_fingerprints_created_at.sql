@@ -0,0 +1,14 @@
+-- +goose Up
+-- +goose StatementBegin
+-- rows that already exist are given the time the migration ran, as the
+-- actual time they were inserted was never recorded
+ALTER TABLE fingerprints ADD COLUMN created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+CREATE INDEX IF NOT EXISTS fingerprints_created_at_idx ON fingerprints (created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS fingerprints_created_at_idx;
+ALTER TABLE fingerprints DROP COLUMN created_at;
+-- +goose StatementEnd
@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+-- the subject of the client certificate that authenticates as this user over mTLS
+ALTER TABLE auth
+    ADD COLUMN cert_subject TEXT UNIQUE;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE auth
+    DROP COLUMN cert_subject;
+-- +goose StatementEnd
@@ -0,0 +1,41 @@
+-- +goose Up
+-- +goose StatementBegin
+-- proxies are stored once and referenced by id, rather than repeating the
+-- address on every fingerprint fetched through them
+CREATE TABLE IF NOT EXISTS sources (
+    id SERIAL PRIMARY KEY,
+    proxy_ip VARCHAR(32) NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    CONSTRAINT sources_proxy_ip_key UNIQUE (proxy_ip)
+);
+
+-- a source is as old as the first fingerprint fetched through it
+INSERT INTO sources (proxy_ip, created_at)
+    SELECT proxy_ip, MIN(created_at) FROM fingerprints GROUP BY proxy_ip;
+
+ALTER TABLE fingerprints ADD COLUMN source_id INT REFERENCES sources (id);
+
+UPDATE fingerprints SET source_id = sources.id FROM sources WHERE sources.proxy_ip = fingerprints.proxy_ip;
+
+ALTER TABLE fingerprints ALTER COLUMN source_id SET NOT NULL;
+
+DROP INDEX IF EXISTS fingerprints_proxy_ip_id_idx;
+ALTER TABLE fingerprints DROP COLUMN proxy_ip;
+
+CREATE INDEX IF NOT EXISTS fingerprints_source_id_id_idx ON fingerprints (source_id, id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE fingerprints ADD COLUMN proxy_ip VARCHAR(32);
+
+UPDATE fingerprints SET proxy_ip = sources.proxy_ip FROM sources WHERE sources.id = fingerprints.source_id;
+
+ALTER TABLE fingerprints ALTER COLUMN proxy_ip SET NOT NULL;
+
+DROP INDEX IF EXISTS fingerprints_source_id_id_idx;
+ALTER TABLE fingerprints DROP COLUMN source_id;
+DROP TABLE sources;
+
+CREATE INDEX IF NOT EXISTS fingerprints_proxy_ip_id_idx ON fingerprints (proxy_ip, id);
+-- +goose StatementEnd
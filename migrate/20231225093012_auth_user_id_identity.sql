@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+-- let postgres assign user ids, two users created at once used to both take
+-- MAX(user_id) + 1. BY DEFAULT so that an older build inserting its own id
+-- during a rolling deploy still works.
+ALTER TABLE auth
+    ALTER COLUMN user_id ADD GENERATED BY DEFAULT AS IDENTITY;
+
+SELECT setval(pg_get_serial_sequence('auth', 'user_id'), COALESCE((SELECT MAX(user_id) FROM auth), 0) + 1, false);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE auth
+    ALTER COLUMN user_id DROP IDENTITY IF EXISTS;
+-- +goose StatementEnd
@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+-- the rows that existed when created_at was added were given the time that
+-- migration ran, not the time they were fetched, so they are cleared. The
+-- migration's goose_db_version row was written in the same transaction, so
+-- its tstamp is that same now().
+ALTER TABLE fingerprints ALTER COLUMN created_at DROP NOT NULL;
+
+UPDATE fingerprints SET created_at = NULL
+    WHERE created_at IN (SELECT tstamp FROM goose_db_version WHERE version_id = 20231204101127);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+UPDATE fingerprints
+    SET created_at = COALESCE((SELECT MAX(tstamp) FROM goose_db_version WHERE version_id = 20231204101127), now())
+    WHERE created_at IS NULL;
+
+ALTER TABLE fingerprints ALTER COLUMN created_at SET NOT NULL;
+-- +goose StatementEnd
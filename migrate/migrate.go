@@ -0,0 +1,114 @@
+// Package migrate embeds the goose migrations so the binary knows which schema
+// version it was built against, and can apply them itself
+package migrate
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed *.sql sqlite/*.sql
+var Files embed.FS
+
+// Dialect picks the set of migrations written for a kind of database
+type Dialect string
+
+const (
+	// the migrations in this directory, which goose can also apply
+	Postgres Dialect = "postgres"
+	// the migrations in sqlite/. They share versions with the postgres
+	// migrations they match, so both sets always end at the same version.
+	SQLite Dialect = "sqlite"
+)
+
+func (d Dialect) pattern() string {
+	if d == SQLite {
+		return "sqlite/*.sql"
+	}
+
+	return "*.sql"
+}
+
+// Migration is a single file, named <version>_<name>.sql
+type Migration struct {
+	Version int64
+	Name    string
+	File    string
+}
+
+// Statements returns the statements to run to apply the migration, or to
+// roll it back if up is false
+func (m Migration) Statements(up bool) ([]string, error) {
+	data, err := Files.ReadFile(m.File)
+
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := Parse(string(data))
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", m.File, err)
+	}
+
+	if up {
+		return parsed.Up, nil
+	}
+
+	return parsed.Down, nil
+}
+
+// List returns every embedded migration for the dialect, oldest first
+func List(dialect Dialect) ([]Migration, error) {
+	files, err := fs.Glob(Files, dialect.pattern())
+
+	if err != nil {
+		return nil, err
+	}
+
+	var out []Migration
+
+	for _, file := range files {
+		base := strings.TrimSuffix(path.Base(file), ".sql")
+		version, name, ok := strings.Cut(base, "_")
+
+		if !ok {
+			return nil, fmt.Errorf("migration %s is not named <version>_<name>.sql", file)
+		}
+
+		parsed, err := strconv.ParseInt(version, 10, 64)
+
+		if err != nil {
+			return nil, fmt.Errorf("migration %s has an invalid version: %w", file, err)
+		}
+
+		out = append(out, Migration{Version: parsed, Name: name, File: file})
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Version < out[j].Version
+	})
+
+	return out, nil
+}
+
+// LatestVersion returns the version the database is expected to be at, which
+// is the same for every dialect
+func LatestVersion() (int64, error) {
+	migrations, err := List(Postgres)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if len(migrations) == 0 {
+		return 0, nil
+	}
+
+	return migrations[len(migrations)-1].Version, nil
+}
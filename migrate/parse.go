@@ -0,0 +1,111 @@
+package migrate
+
+import (
+	"errors"
+	"strings"
+)
+
+// Parsed is a migration file split into statements, following the goose
+// annotations it is written with
+type Parsed struct {
+	Up   []string
+	Down []string
+}
+
+const (
+	annotationUp             = "-- +goose Up"
+	annotationDown           = "-- +goose Down"
+	annotationStatementBegin = "-- +goose StatementBegin"
+	annotationStatementEnd   = "-- +goose StatementEnd"
+)
+
+// Parse splits a migration into its up and down statements. Outside of a
+// StatementBegin/StatementEnd block a statement ends at a line ending in a
+// semicolon, inside one the whole block is a single statement.
+func Parse(source string) (Parsed, error) {
+	var out Parsed
+	var current *[]string
+	var buf strings.Builder
+
+	inBlock := false
+
+	flush := func() {
+		if statement := strings.TrimSpace(buf.String()); statement != "" {
+			*current = append(*current, statement)
+		}
+
+		buf.Reset()
+	}
+
+	for _, line := range strings.Split(source, "\n") {
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case strings.HasPrefix(trimmed, annotationUp):
+			if inBlock {
+				return Parsed{}, errors.New("+goose Up inside a statement block")
+			}
+
+			current = &out.Up
+			continue
+
+		case strings.HasPrefix(trimmed, annotationDown):
+			if inBlock {
+				return Parsed{}, errors.New("+goose Down inside a statement block")
+			}
+
+			current = &out.Down
+			continue
+
+		case strings.HasPrefix(trimmed, annotationStatementBegin):
+			if current == nil || inBlock {
+				return Parsed{}, errors.New("unexpected +goose StatementBegin")
+			}
+
+			inBlock = true
+			continue
+
+		case strings.HasPrefix(trimmed, annotationStatementEnd):
+			if !inBlock {
+				return Parsed{}, errors.New("+goose StatementEnd without StatementBegin")
+			}
+
+			flush()
+			inBlock = false
+			continue
+		}
+
+		if current == nil {
+			if trimmed != "" && !strings.HasPrefix(trimmed, "--") {
+				return Parsed{}, errors.New("statement before +goose Up")
+			}
+
+			continue
+		}
+
+		if !inBlock && (trimmed == "" || strings.HasPrefix(trimmed, "--")) {
+			continue
+		}
+
+		buf.WriteString(line)
+		buf.WriteString("\n")
+
+		if !inBlock && strings.HasSuffix(trimmed, ";") {
+			flush()
+		}
+	}
+
+	if inBlock {
+		return Parsed{}, errors.New("+goose StatementBegin without StatementEnd")
+	}
+
+	if buf.Len() > 0 {
+		return Parsed{}, errors.New("statement is missing its closing semicolon")
+	}
+
+	if out.Up == nil {
+		return Parsed{}, errors.New("no +goose Up statements")
+	}
+
+	return out, nil
+}
@@ -0,0 +1,114 @@
+package migrate
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	source := `-- +goose Up
+-- a comment about the migration
+CREATE TABLE a (id INT);
+ALTER TABLE a
+    ADD COLUMN b INT;
+
+-- +goose StatementBegin
+CREATE FUNCTION f() RETURNS INT AS $$
+BEGIN
+    RETURN 1;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose Down
+DROP FUNCTION f;
+DROP TABLE a;
+`
+
+	parsed, err := Parse(source)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	up := []string{
+		"CREATE TABLE a (id INT);",
+		"ALTER TABLE a\n    ADD COLUMN b INT;",
+		"CREATE FUNCTION f() RETURNS INT AS $$\nBEGIN\n    RETURN 1;\nEND;\n$$ LANGUAGE plpgsql;",
+	}
+
+	if !reflect.DeepEqual(parsed.Up, up) {
+		t.Errorf("unexpected up statements %q", parsed.Up)
+	}
+
+	if !reflect.DeepEqual(parsed.Down, []string{"DROP FUNCTION f;", "DROP TABLE a;"}) {
+		t.Errorf("unexpected down statements %q", parsed.Down)
+	}
+}
+
+func TestParseRejectsMalformed(t *testing.T) {
+	cases := map[string]string{
+		"no up":         "CREATE TABLE a (id INT);\n",
+		"open block":    "-- +goose Up\n-- +goose StatementBegin\nSELECT 1;\n",
+		"stray end":     "-- +goose Up\n-- +goose StatementEnd\n",
+		"no semicolon":  "-- +goose Up\nSELECT 1\n",
+		"nothing to do": "-- +goose Down\nSELECT 1;\n",
+	}
+
+	for name, source := range cases {
+		if _, err := Parse(source); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestEmbeddedMigrationsParse(t *testing.T) {
+	for _, dialect := range []Dialect{Postgres, SQLite} {
+		migrations, err := List(dialect)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(migrations) == 0 {
+			t.Fatalf("no %s migrations are embedded", dialect)
+		}
+
+		for _, migration := range migrations {
+			for _, up := range []bool{true, false} {
+				statements, err := migration.Statements(up)
+
+				if err != nil {
+					t.Error(err)
+					continue
+				}
+
+				if len(statements) == 0 {
+					t.Errorf("%s has no statements (up=%v)", migration.File, up)
+				}
+			}
+		}
+	}
+}
+
+// a postgres migration needs a sqlite one with the same version, or sqlite
+// databases would never look up to date
+func TestDialectsAgree(t *testing.T) {
+	postgres, err := List(Postgres)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sqlite, err := List(SQLite)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	latest := postgres[len(postgres)-1].Version
+
+	if got := sqlite[len(sqlite)-1].Version; got != latest {
+		t.Errorf("the newest sqlite migration is %d, the newest postgres migration is %d", got, latest)
+	}
+}
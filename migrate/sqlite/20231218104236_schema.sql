@@ -0,0 +1,84 @@
+-- +goose Up
+-- +goose StatementBegin
+-- the schema the postgres migrations arrive at by this version. sqlite support
+-- was added here, so there are no older sqlite databases to bring forward.
+--
+-- timestamps are written by the application, in UTC and in a single format,
+-- so that they compare correctly as text
+CREATE TABLE IF NOT EXISTS auth (
+    user_id INTEGER PRIMARY KEY,
+    permissions INTEGER NOT NULL,
+    token_prefix TEXT NOT NULL,
+    token_salt BLOB NOT NULL,
+    token_hash BLOB NOT NULL,
+    label TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP,
+    last_used_at TIMESTAMP,
+    cert_subject TEXT UNIQUE
+);
+
+CREATE INDEX IF NOT EXISTS auth_token_prefix_idx ON auth (token_prefix);
+
+CREATE TABLE IF NOT EXISTS sources (
+    id INTEGER PRIMARY KEY,
+    proxy_ip TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMP NOT NULL
+);
+
+-- AUTOINCREMENT so that ids freed by the retention job are never reused,
+-- matching postgres and keeping list cursors valid
+CREATE TABLE IF NOT EXISTS fingerprints (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    fingerprint TEXT NOT NULL,
+    source_id INTEGER NOT NULL REFERENCES sources (id),
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS fingerprints_created_at_idx ON fingerprints (created_at);
+CREATE INDEX IF NOT EXISTS fingerprints_source_id_id_idx ON fingerprints (source_id, id);
+
+CREATE TABLE IF NOT EXISTS rate_limit_counters (
+    user_id INTEGER NOT NULL,
+    bucket TEXT NOT NULL,
+    window_start TIMESTAMP NOT NULL,
+    count INTEGER NOT NULL,
+    PRIMARY KEY (user_id, bucket, window_start)
+);
+
+CREATE TABLE IF NOT EXISTS audit_log (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    created_at TIMESTAMP NOT NULL,
+    request_id TEXT NOT NULL,
+    user_id INTEGER NOT NULL,
+    method TEXT NOT NULL,
+    route TEXT NOT NULL,
+    status INTEGER NOT NULL,
+    duration_ms INTEGER NOT NULL,
+    remote_addr TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_created_at_idx ON audit_log (created_at);
+CREATE INDEX IF NOT EXISTS audit_log_user_id_created_at_idx ON audit_log (user_id, created_at);
+
+CREATE TABLE IF NOT EXISTS console_sessions (
+    id_hash BLOB PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES auth (user_id) ON DELETE CASCADE,
+    csrf_token TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS console_sessions_expires_at_idx ON console_sessions (expires_at);
+CREATE INDEX IF NOT EXISTS console_sessions_user_id_idx ON console_sessions (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE console_sessions;
+DROP TABLE audit_log;
+DROP TABLE rate_limit_counters;
+DROP TABLE fingerprints;
+DROP TABLE sources;
+DROP TABLE auth;
+-- +goose StatementEnd
@@ -0,0 +1,81 @@
+-- +goose Up
+-- +goose StatementBegin
+-- AUTOINCREMENT so that the id of a revoked user is never given to a new one,
+-- matching the identity column in postgres. sqlite cannot alter a primary key,
+-- so the table is rebuilt. console_sessions is rebuilt along with it, dropping
+-- auth while it is still referenced would delete every session.
+CREATE TABLE auth_new (
+    user_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    permissions INTEGER NOT NULL,
+    token_prefix TEXT NOT NULL,
+    token_salt BLOB NOT NULL,
+    token_hash BLOB NOT NULL,
+    label TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP,
+    last_used_at TIMESTAMP,
+    cert_subject TEXT UNIQUE
+);
+
+INSERT INTO auth_new SELECT user_id, permissions, token_prefix, token_salt, token_hash, label, created_at, expires_at, last_used_at, cert_subject FROM auth;
+
+CREATE TABLE console_sessions_old AS SELECT * FROM console_sessions;
+DROP TABLE console_sessions;
+DROP TABLE auth;
+ALTER TABLE auth_new RENAME TO auth;
+
+CREATE INDEX IF NOT EXISTS auth_token_prefix_idx ON auth (token_prefix);
+
+CREATE TABLE console_sessions (
+    id_hash BLOB PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES auth (user_id) ON DELETE CASCADE,
+    csrf_token TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+INSERT INTO console_sessions SELECT id_hash, user_id, csrf_token, created_at, expires_at FROM console_sessions_old;
+DROP TABLE console_sessions_old;
+
+CREATE INDEX IF NOT EXISTS console_sessions_expires_at_idx ON console_sessions (expires_at);
+CREATE INDEX IF NOT EXISTS console_sessions_user_id_idx ON console_sessions (user_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+CREATE TABLE auth_old (
+    user_id INTEGER PRIMARY KEY,
+    permissions INTEGER NOT NULL,
+    token_prefix TEXT NOT NULL,
+    token_salt BLOB NOT NULL,
+    token_hash BLOB NOT NULL,
+    label TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP,
+    last_used_at TIMESTAMP,
+    cert_subject TEXT UNIQUE
+);
+
+INSERT INTO auth_old SELECT user_id, permissions, token_prefix, token_salt, token_hash, label, created_at, expires_at, last_used_at, cert_subject FROM auth;
+
+CREATE TABLE console_sessions_old AS SELECT * FROM console_sessions;
+DROP TABLE console_sessions;
+DROP TABLE auth;
+ALTER TABLE auth_old RENAME TO auth;
+
+CREATE INDEX IF NOT EXISTS auth_token_prefix_idx ON auth (token_prefix);
+
+CREATE TABLE console_sessions (
+    id_hash BLOB PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES auth (user_id) ON DELETE CASCADE,
+    csrf_token TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+INSERT INTO console_sessions SELECT id_hash, user_id, csrf_token, created_at, expires_at FROM console_sessions_old;
+DROP TABLE console_sessions_old;
+
+CREATE INDEX IF NOT EXISTS console_sessions_expires_at_idx ON console_sessions (expires_at);
+CREATE INDEX IF NOT EXISTS console_sessions_user_id_idx ON console_sessions (user_id);
+-- +goose StatementEnd
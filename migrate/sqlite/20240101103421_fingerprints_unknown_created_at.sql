@@ -0,0 +1,12 @@
+-- +goose Up
+-- +goose StatementBegin
+-- sqlite databases start from a schema that already records created_at, so no
+-- fingerprint was given the time of a migration and there is nothing to clear.
+-- This only keeps the versions in step with postgres.
+SELECT 1;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+SELECT 1;
+-- +goose StatementEnd
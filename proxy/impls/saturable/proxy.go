@@ -87,13 +87,10 @@ func (p *SaturableProxy) incrementFail() {
 	}
 }
 
-// TODO: is it acceptable to leak the cancel here? we know the parent context will eventually be cancelled...
+// both resetters stop once the parent context is done
 func (p *SaturableProxy) startChannels(ctx context.Context) {
-	usedCtx, _ := context.WithCancel(ctx)
-	go p.runTimesUsedResetter(usedCtx)
-
-	failedCtx, _ := context.WithCancel(ctx)
-	go p.runTimesFailedResetter(failedCtx)
+	go p.runTimesUsedResetter(ctx)
+	go p.runTimesFailedResetter(ctx)
 }
 
 func (p *SaturableProxy) runTimesUsedResetter(ctx context.Context) {
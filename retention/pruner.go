@@ -0,0 +1,117 @@
+// Package retention deletes the fingerprints that a database.RetentionPolicy
+// no longer keeps
+package retention
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/database"
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/metrics"
+	"go.uber.org/zap"
+)
+
+const DefaultInterval = time.Hour
+const DefaultBatchSize = 1000
+
+type Pruner struct {
+	store     database.Store
+	policy    database.RetentionPolicy
+	interval  time.Duration
+	batchSize uint64
+	log       *zap.Logger
+}
+
+type NewPrunerOptions struct {
+	Store  database.Store
+	Policy database.RetentionPolicy
+	// how often to prune, DefaultInterval if zero
+	Interval time.Duration
+	// the most fingerprints a single statement deletes, DefaultBatchSize if zero
+	BatchSize uint64
+}
+
+func NewPruner(options NewPrunerOptions) *Pruner {
+	p := &Pruner{
+		store:     options.Store,
+		policy:    options.Policy,
+		interval:  options.Interval,
+		batchSize: options.BatchSize,
+		log:       zap.L().Named("retention"),
+	}
+
+	if p.interval <= 0 {
+		p.interval = DefaultInterval
+	}
+
+	if p.batchSize == 0 {
+		p.batchSize = DefaultBatchSize
+	}
+
+	return p
+}
+
+// Run prunes straight away and then every interval, until ctx is done
+func (p *Pruner) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		start := time.Now()
+		deleted, err := p.Prune(ctx)
+
+		switch {
+		case err != nil && errors.Is(err, context.Canceled):
+			// shutting down, the rest is deleted next time
+		case err != nil:
+			metrics.RetentionFailures.Inc()
+			p.log.Error("could not prune fingerprints", zap.Uint64("deleted", deleted), zap.Error(err))
+		case deleted > 0:
+			p.log.Info("pruned fingerprints", zap.Uint64("deleted", deleted), zap.Duration("took", time.Since(start)))
+		default:
+			p.log.Debug("nothing to prune")
+		}
+
+		select {
+		case <-ctx.Done():
+			p.log.Info("exiting")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Prune deletes everything the policy no longer keeps, oldest first and a
+// batch at a time, returning how many fingerprints were deleted
+func (p *Pruner) Prune(ctx context.Context) (uint64, error) {
+	report, err := p.store.CheckRetention(ctx, p.policy)
+
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted uint64
+
+	// the boundary is fixed up front, so fingerprints that expire while this
+	// runs are left for the next run rather than keeping it going
+	for deleted < report.Count {
+		if err := ctx.Err(); err != nil {
+			return deleted, err
+		}
+
+		n, err := p.store.DeleteFingerprintsUpTo(ctx, report.MaxID, p.batchSize)
+		deleted += n
+		metrics.RetentionDeleted.Add(float64(n))
+
+		if err != nil {
+			return deleted, err
+		}
+
+		if n < p.batchSize {
+			break
+		}
+	}
+
+	return deleted, nil
+}
@@ -0,0 +1,73 @@
+package retention
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/getaddrinfo/proxy-fingerprint-scraper/database"
+)
+
+// seed adds count fingerprints, an hour apart, the newest fetched just now
+func seed(store *database.MemoryStore, count int) {
+	for i := 0; i < count; i++ {
+		store.AddFingerprint(fmt.Sprintf("fp-%d", i+1), "192.0.2.1", time.Now().Add(-time.Duration(count-i-1)*time.Hour))
+	}
+}
+
+func TestPrune(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy database.RetentionPolicy
+		kept   uint64
+	}{
+		{"disabled", database.RetentionPolicy{}, 10},
+		{"max age", database.RetentionPolicy{MaxAge: time.Hour*3 + time.Minute}, 4},
+		{"max rows", database.RetentionPolicy{MaxRows: 6}, 6},
+		{"both, age is stricter", database.RetentionPolicy{MaxAge: time.Hour + time.Minute, MaxRows: 6}, 2},
+		{"both, rows is stricter", database.RetentionPolicy{MaxAge: time.Hour * 24, MaxRows: 3}, 3},
+		{"nothing expired", database.RetentionPolicy{MaxAge: time.Hour * 24, MaxRows: 100}, 10},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := database.NewMemoryStore()
+			seed(store, 10)
+
+			// a batch smaller than the work, so that several are needed
+			pruner := NewPruner(NewPrunerOptions{Store: store, Policy: test.policy, BatchSize: 2})
+
+			report, err := store.CheckRetention(context.Background(), test.policy)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if report.Count != 10-test.kept {
+				t.Errorf("expected the dry run to report %d, got %d", 10-test.kept, report.Count)
+			}
+
+			deleted, err := pruner.Prune(context.Background())
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if deleted != report.Count {
+				t.Errorf("expected %d deleted, got %d", report.Count, deleted)
+			}
+
+			count, _ := store.CountFingerprints(context.Background())
+
+			if count != test.kept {
+				t.Errorf("expected %d kept, got %d", test.kept, count)
+			}
+
+			// what is left is the newest
+			if _, err := store.GetSpecificFingerprint(context.Background(), 10); err != nil {
+				t.Error("expected the newest fingerprint to be kept")
+			}
+		})
+	}
+}